@@ -0,0 +1,105 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// topUpAmounts – суммы пополнения баланса, предлагаемые пользователю.
+var topUpAmounts = []int{100, 300, 500, 1000}
+
+// balanceKindLabels – подписи типов движения средств в истории баланса.
+var balanceKindLabels = map[string]string{
+	services.BalanceTopUp:    "Пополнение",
+	services.BalanceReferral: "Бонус за друга",
+	services.BalanceRefund:   "Возврат",
+	services.BalanceAdmin:    "Корректировка",
+	services.BalancePurchase: "Оплата подписки",
+}
+
+// sendBalance отправляет пользователю текущий баланс, последние операции и кнопки пополнения.
+func sendBalance(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+	var transactions []db.BalanceTransaction
+	if err := db.DB.Where("user_id = ?", user.ID).
+		Order("created_at DESC").
+		Limit(5).
+		Find(&transactions).Error; err != nil {
+		log.Printf("🔴 Ошибка получения истории баланса пользователя %d: %v", user.ID, err)
+	}
+
+	text := fmt.Sprintf("💰 Ваш баланс: %.2f₽\n\nБалансом можно оплатить подписку полностью или частично.", user.Balance)
+	if len(transactions) > 0 {
+		text += "\n\n🧾 Последние операции:"
+		for _, t := range transactions {
+			text += fmt.Sprintf("\n%s  %+.2f₽  %s", t.CreatedAt.Format("02.01.2006"), t.Amount, balanceKindLabels[t.Kind])
+		}
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+	for _, amount := range topUpAmounts {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("+%d₽", amount), fmt.Sprintf("topup_%d", amount)))
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(row)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("🔴 Ошибка отправки баланса: %v", err)
+	}
+}
+
+// createTopUpPayment создаёт платеж пополнения баланса через Юкассу.
+// method – код способа оплаты в Юкассе; пустой method означает, что пользователь его ещё не выбрал.
+func createTopUpPayment(bot *tgbotapi.BotAPI, chatID int64, user *db.User, amount int, method string) {
+	allowed := false
+	for _, a := range topUpAmounts {
+		if a == amount {
+			allowed = true
+		}
+	}
+	if !allowed {
+		bot.Send(tgbotapi.NewMessage(chatID, "Некорректная сумма пополнения."))
+		return
+	}
+
+	if method == "" && askPaymentMethod(bot, chatID, fmt.Sprintf("topup_%d", amount)) {
+		return
+	}
+	if !ensureReceiptContact(bot, chatID, user, func(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+		createTopUpPayment(bot, chatID, user, amount, method)
+	}) {
+		return
+	}
+
+	payment := db.Payment{
+		UserID:        user.ID,
+		Kind:          db.PaymentKindTopUp,
+		Amount:        float64(amount),
+		Status:        db.PaymentPending,
+		ReceiptStatus: services.ReceiptPending,
+	}
+	receipt, err := services.PaymentReceipt(user, payment, payment.Amount)
+	if err != nil {
+		log.Printf("🔴 Ошибка формирования чека пополнения: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при создании платежа. Попробуйте позже."))
+		return
+	}
+	paymentID, paymentURL, err := services.CreateYooKassaPayment(user.ID, payment.Amount, services.PaymentMethodType(method), false, receipt)
+	if err != nil {
+		log.Printf("🔴 Ошибка создания платежа пополнения: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при создании платежа. Попробуйте позже."))
+		return
+	}
+	payment.YooKassaID = paymentID
+	if err := db.DB.Create(&payment).Error; err != nil {
+		log.Printf("🔴 Ошибка записи платежа пополнения в БД: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при записи платежа. Попробуйте позже."))
+		return
+	}
+
+	text := fmt.Sprintf("💰 Пополнение баланса на %d₽.\n\nПерейдите по ссылке для оплаты:\n%s", amount, paymentURL)
+	bot.Send(tgbotapi.NewMessage(chatID, text))
+}
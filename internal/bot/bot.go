@@ -4,6 +4,8 @@ import (
 	"log"
 	"os"
 
+	"vpn-bot/internal/services"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
@@ -22,6 +24,11 @@ func StartBot() {
 	bot.Debug = false
 	log.Printf("✅ Бот запущен: %s", bot.Self.UserName)
 
+	// Уведомления из сервисов (веб-хук, проверка платежей, напоминания) отправляем через этого бота
+	services.SetNotifier(services.NewTelegramNotifier(bot))
+	// После оплаты Юкасса возвращает пользователя обратно в бота
+	services.SetDefaultReturnURL("https://t.me/" + bot.Self.UserName)
+
 	// Конфигурация получения обновлений
 	updateConfig := tgbotapi.NewUpdate(0)
 	updateConfig.Timeout = 60
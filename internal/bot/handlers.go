@@ -7,35 +7,46 @@ import (
 	"strings"
 
 	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
 // HandleUpdate обрабатывает входящие обновления (сообщения и callback'и)
 func HandleUpdate(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
-	// Обработка текстовых сообщений
+	// Определяем отправителя обновления
+	var from *tgbotapi.User
+	var chatID int64
 	if update.Message != nil {
-		switch update.Message.Text {
-		case "/start":
-			sendStartMenu(bot, update.Message.Chat.ID)
-		case "/support":
-			sendSupportInfo(bot, update.Message.Chat.ID)
-		case "/buy":
-			// Отправляем выбор сервера для покупки подписки
-			sendServerSelection(bot, update.Message.Chat.ID)
-		default:
-			sendUnknownCommand(bot, update.Message.Chat.ID)
-		}
+		from, chatID = update.Message.From, update.Message.Chat.ID
+	} else if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		from, chatID = update.CallbackQuery.From, update.CallbackQuery.Message.Chat.ID
+	}
+	if from == nil {
+		return
+	}
+
+	// Создаём или обновляем запись пользователя при каждом обращении
+	user, err := services.UpsertTelegramUser(from)
+	if err != nil {
+		log.Printf("🔴 Ошибка сохранения пользователя %d: %v", from.ID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при обработке запроса. Попробуйте позже."))
+		return
+	}
+
+	// Обработка текстовых сообщений: команды и кнопки клавиатуры
+	if update.Message != nil {
+		routeMessage(bot, user, update.Message)
 	}
 
 	// Обработка callback-запросов (inline-кнопки)
 	if update.CallbackQuery != nil {
-		handleCallback(bot, update.CallbackQuery)
+		handleCallback(bot, user, update.CallbackQuery)
 	}
 }
 
 // sendStartMenu отправляет главное меню пользователю
-func sendStartMenu(bot *tgbotapi.BotAPI, chatID int64) {
+func sendStartMenu(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
 	text := "Привет! Выберите действие:"
 	// Клавиатура с основными командами
 	keyboard := tgbotapi.NewReplyKeyboard(
@@ -47,7 +58,15 @@ func sendStartMenu(bot *tgbotapi.BotAPI, chatID int64) {
 			tgbotapi.NewKeyboardButton("📊 Мои подписки"),
 			tgbotapi.NewKeyboardButton("📨 Поддержка"),
 		),
+		tgbotapi.NewKeyboardButtonRow(
+			tgbotapi.NewKeyboardButton("👥 Пригласить друга"),
+			tgbotapi.NewKeyboardButton("💰 Баланс"),
+		),
 	)
+	// Кнопку пробного периода показываем, пока пользователь им не воспользовался
+	if user.TrialUsedAt == nil && services.TrialDays() > 0 {
+		keyboard.Keyboard[2] = append(keyboard.Keyboard[2], tgbotapi.NewKeyboardButton("🎁 Пробный период"))
+	}
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ReplyMarkup = keyboard
 	if _, err := bot.Send(msg); err != nil {
@@ -74,8 +93,9 @@ func sendUnknownCommand(bot *tgbotapi.BotAPI, chatID int64) {
 	}
 }
 
-// sendServerSelection отправляет пользователю список доступных серверов (локаций)
-func sendServerSelection(bot *tgbotapi.BotAPI, chatID int64) {
+// sendServerSelection отправляет пользователю список доступных серверов (локаций).
+// callbackPrefix задаёт действие по выбору сервера, к нему добавляется ID сервера.
+func sendServerSelection(bot *tgbotapi.BotAPI, chatID int64, callbackPrefix string) {
 	var servers []db.Server
 	if err := db.DB.Where("is_active = ?", true).Find(&servers).Error; err != nil {
 		log.Printf("🔴 Ошибка получения серверов: %v", err)
@@ -93,7 +113,7 @@ func sendServerSelection(bot *tgbotapi.BotAPI, chatID int64) {
 	text := "Выберите локацию:"
 	var rows [][]tgbotapi.InlineKeyboardButton
 	for _, server := range servers {
-		btn := tgbotapi.NewInlineKeyboardButtonData(server.Name, fmt.Sprintf("select_server_%d", server.ID))
+		btn := tgbotapi.NewInlineKeyboardButtonData(server.Name, fmt.Sprintf("%s%d", callbackPrefix, server.ID))
 		rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
 	}
 	keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
@@ -105,7 +125,7 @@ func sendServerSelection(bot *tgbotapi.BotAPI, chatID int64) {
 }
 
 // handleCallback обрабатывает callback-запросы от inline-кнопок
-func handleCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery) {
+func handleCallback(bot *tgbotapi.BotAPI, user *db.User, callback *tgbotapi.CallbackQuery) {
 	data := callback.Data
 
 	if strings.HasPrefix(data, "select_server_") {
@@ -116,9 +136,11 @@ func handleCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery) {
 			log.Printf("🔴 Ошибка преобразования serverID: %v", err)
 			return
 		}
-		sendTariffSelection(bot, callback.Message.Chat.ID, serverID)
+		sendTariffSelection(bot, callback.Message.Chat.ID, user, serverID)
 	} else if strings.HasPrefix(data, "buy_") {
-		// Обработка выбора тарифа, формат: buy_<serverID>_<месяцев>
+		// Обработка выбора тарифа, форматы: buy_<serverID>_<planID>, buy_<serverID>_<planID>_<источник оплаты>,
+		// buy_<serverID>_<planID>_<источник оплаты>_<способ оплаты> и buy_<serverID>_<planID>_<источник оплаты>_<способ оплаты>_<on|off>,
+		// где on/off – выбор автопродления
 		parts := strings.Split(data, "_")
 		if len(parts) < 3 {
 			log.Printf("🔴 Некорректный формат данных для покупки: %s", data)
@@ -129,13 +151,81 @@ func handleCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery) {
 			log.Printf("🔴 Ошибка преобразования serverID в callback: %v", err)
 			return
 		}
-		months, err := strconv.Atoi(parts[2])
+		planID, err := strconv.Atoi(parts[2])
 		if err != nil {
-			log.Printf("🔴 Ошибка преобразования месяцев в callback: %v", err)
+			log.Printf("🔴 Ошибка преобразования planID в callback: %v", err)
 			return
 		}
+		source, method, autoRenew := paymentChoice(parts[3:])
 		// Вызываем функцию резервирования ключа и создания платежа
-		reserveKeyAndCreatePayment(bot, callback.Message.Chat.ID, serverID, months)
+		reserveKeyAndCreatePayment(bot, callback.Message.Chat.ID, user, serverID, planID, source, method, autoRenew)
+	} else if strings.HasPrefix(data, "sub_key_") {
+		// Показ VLESS-ключа подписки, формат: sub_key_<subscriptionID>
+		subscriptionID, err := strconv.Atoi(strings.TrimPrefix(data, "sub_key_"))
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования subscriptionID: %v", err)
+			return
+		}
+		sendSubscriptionKey(bot, callback.Message.Chat.ID, user, subscriptionID)
+	} else if strings.HasPrefix(data, "autorenew_") {
+		// Переключение автопродления подписки, формат: autorenew_<subscriptionID>
+		subscriptionID, err := strconv.Atoi(strings.TrimPrefix(data, "autorenew_"))
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования subscriptionID: %v", err)
+			return
+		}
+		toggleAutoRenew(bot, callback.Message.Chat.ID, user, subscriptionID)
+	} else if strings.HasPrefix(data, "renew_") {
+		// Продление подписки, форматы: renew_<subscriptionID>, renew_<subscriptionID>_<planID>
+		// renew_<subscriptionID>_<planID>_<источник оплаты> и renew_<subscriptionID>_<planID>_<источник оплаты>_<способ оплаты>
+		parts := strings.Split(data, "_")
+		subscriptionID, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования subscriptionID: %v", err)
+			return
+		}
+		if len(parts) < 3 {
+			sendRenewTariffSelection(bot, callback.Message.Chat.ID, user, subscriptionID)
+			return
+		}
+		planID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования planID в callback: %v", err)
+			return
+		}
+		source, method, _ := paymentChoice(parts[3:])
+		createRenewalPayment(bot, callback.Message.Chat.ID, user, subscriptionID, planID, source, method)
+	} else if strings.HasPrefix(data, "trial_") {
+		// Активация пробного периода, формат: trial_<serverID>
+		serverID, err := strconv.Atoi(strings.TrimPrefix(data, "trial_"))
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования serverID: %v", err)
+			return
+		}
+		activateTrial(bot, callback.Message.Chat.ID, user, serverID)
+	} else if strings.HasPrefix(data, "topup_") {
+		// Пополнение баланса, форматы: topup_<сумма> и topup_<сумма>_<способ оплаты>
+		parts := strings.Split(data, "_")
+		amount, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования суммы пополнения: %v", err)
+			return
+		}
+		method := ""
+		if len(parts) > 2 {
+			method = parts[2]
+		}
+		createTopUpPayment(bot, callback.Message.Chat.ID, user, amount, method)
+	} else if strings.HasPrefix(data, "promo_") {
+		// Ввод промокода на шаге выбора тарифа, формат: promo_<serverID>
+		serverID, err := strconv.Atoi(strings.TrimPrefix(data, "promo_"))
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования serverID: %v", err)
+			return
+		}
+		requestPromoCode(bot, callback.Message.Chat.ID, user, serverID)
+	} else if data == "support" {
+		sendSupportInfo(bot, callback.Message.Chat.ID)
 	} else {
 		// Неизвестный callback
 		msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Неизвестное действие.")
@@ -143,8 +233,23 @@ func handleCallback(bot *tgbotapi.BotAPI, callback *tgbotapi.CallbackQuery) {
 	}
 }
 
-// sendTariffSelection отправляет пользователю выбор тарифов для выбранного сервера
-func sendTariffSelection(bot *tgbotapi.BotAPI, chatID int64, serverID int) {
+// paymentChoice разбирает необязательные хвостовые части callback-данных оплаты:
+// источник оплаты, код способа оплаты и выбор автопродления (autoRenewOn или autoRenewOff).
+func paymentChoice(parts []string) (source, method, autoRenew string) {
+	if len(parts) > 0 {
+		source = parts[0]
+	}
+	if len(parts) > 1 {
+		method = parts[1]
+	}
+	if len(parts) > 2 {
+		autoRenew = parts[2]
+	}
+	return source, method, autoRenew
+}
+
+// sendTariffSelection отправляет пользователю выбор тарифных планов для выбранного сервера
+func sendTariffSelection(bot *tgbotapi.BotAPI, chatID int64, user *db.User, serverID int) {
 	var server db.Server
 	if err := db.DB.First(&server, serverID).Error; err != nil {
 		msg := tgbotapi.NewMessage(chatID, "Ошибка: сервер не найден.")
@@ -152,21 +257,97 @@ func sendTariffSelection(bot *tgbotapi.BotAPI, chatID int64, serverID int) {
 		return
 	}
 
-	text := fmt.Sprintf("Вы выбрали сервер *%s*.\nВыберите тариф подписки:", server.Name)
-	keyboard := tgbotapi.NewInlineKeyboardMarkup(
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("1 месяц - 500₽", fmt.Sprintf("buy_%d_1", serverID)),
-			tgbotapi.NewInlineKeyboardButtonData("3 месяца - 1425₽ (-5%%)", fmt.Sprintf("buy_%d_3", serverID)),
-		),
-		tgbotapi.NewInlineKeyboardRow(
-			tgbotapi.NewInlineKeyboardButtonData("6 месяцев - 2700₽ (-10%%)", fmt.Sprintf("buy_%d_6", serverID)),
-			tgbotapi.NewInlineKeyboardButtonData("12 месяцев - 5100₽ (-15%%)", fmt.Sprintf("buy_%d_12", serverID)),
-		),
-	)
+	plans, err := services.ActivePlans(serverID)
+	if err != nil {
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при получении тарифов."))
+		return
+	}
+	if len(plans) == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "Для этого сервера пока нет доступных тарифов 😞"))
+		return
+	}
+	promo := sessionPromo(user)
+
+	// Выводим планы по два в ряд
+	var rows [][]tgbotapi.InlineKeyboardButton
+	var row []tgbotapi.InlineKeyboardButton
+	for _, plan := range plans {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(planButtonLabel(services.QuotePlan(user, serverID, plan, promo)), fmt.Sprintf("buy_%d_%d", serverID, plan.ID)))
+		if len(row) == 2 {
+			rows = append(rows, row)
+			row = nil
+		}
+	}
+	if len(row) > 0 {
+		rows = append(rows, row)
+	}
+	rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("🎟 У меня есть промокод", fmt.Sprintf("promo_%d", serverID)),
+	))
+
+	text := fmt.Sprintf("Вы выбрали сервер *%s*.\n", server.Name) + discountNotice(user) + promoNotice(promo) + "Выберите тариф подписки:"
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = "Markdown"
-	msg.ReplyMarkup = keyboard
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
 	if _, err := bot.Send(msg); err != nil {
 		log.Printf("🔴 Ошибка отправки выбора тарифа: %v", err)
 	}
 }
+
+// planButtonLabel формирует подпись кнопки тарифного плана, например "3 месяца - 1425₽ (-5%)".
+// При персональной скидке выводятся обе суммы: "3 месяца - 1282₽ вместо 1425₽".
+func planButtonLabel(quote services.Quote) string {
+	label := fmt.Sprintf("%s - %.0f₽", services.MonthsLabel(quote.Plan.Months), quote.FinalPrice)
+	if quote.HasDiscount() {
+		label += fmt.Sprintf(" вместо %.0f₽", quote.BasePrice)
+	} else if quote.Plan.DiscountLabel != "" {
+		label += fmt.Sprintf(" (%s)", quote.Plan.DiscountLabel)
+	}
+	return label
+}
+
+// discountNotice возвращает строку о действующей персональной скидке пользователя или пустую строку.
+func discountNotice(user *db.User) string {
+	percent := services.ActiveDiscount(user)
+	if percent == 0 {
+		return ""
+	}
+	if user.DiscountUntil != nil {
+		return fmt.Sprintf("🎁 Ваша персональная скидка: %d%% (до %s)\n", percent, user.DiscountUntil.Format("02.01.2006"))
+	}
+	return fmt.Sprintf("🎁 Ваша персональная скидка: %d%%\n", percent)
+}
+
+// promoNotice возвращает строку о применённом промокоде для сообщения с разметкой Markdown
+// или пустую строку.
+func promoNotice(promo *db.PromoCode) string {
+	if promo == nil {
+		return ""
+	}
+	return fmt.Sprintf("🎟 Промокод %s: %s\n", escapeMarkdown(promo.Code), promoDiscountText(promo))
+}
+
+// markdownEscaper экранирует служебные символы разметки Markdown.
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+// escapeMarkdown экранирует текст, вставляемый в сообщение с разметкой Markdown, чтобы
+// символы вроде "_" в SUMMER_SALE не ломали разметку и Telegram не отклонял сообщение.
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// priceText формирует строку суммы к оплате, при скидках – с исходной ценой и их составом.
+func priceText(quote services.Quote) string {
+	if !quote.HasDiscount() {
+		return fmt.Sprintf("%.2f₽", quote.FinalPrice)
+	}
+	var details []string
+	if quote.DiscountPercent > 0 {
+		details = append(details, fmt.Sprintf("персональная скидка %d%%", quote.DiscountPercent))
+	}
+	if quote.PromoCode != nil {
+		details = append(details, fmt.Sprintf("промокод %s: -%.2f₽", quote.PromoCode.Code, quote.PromoDiscount))
+	}
+	return fmt.Sprintf("%.2f₽ (вместо %.2f₽; %s)", quote.FinalPrice, quote.BasePrice, strings.Join(details, "; "))
+}
@@ -0,0 +1,74 @@
+package bot
+
+import (
+	"testing"
+
+	"vpn-bot/internal/db"
+)
+
+func TestEscapeMarkdown(t *testing.T) {
+	tests := map[string]string{
+		"SUMMER2024":   "SUMMER2024",
+		"SUMMER_SALE":  `SUMMER\_SALE`,
+		"*VIP*":        `\*VIP\*`,
+		"[A]`B`":       "\\[A]\\`B\\`",
+		"ПРОМО_ДРУЗЬЯ": `ПРОМО\_ДРУЗЬЯ`,
+	}
+	for text, want := range tests {
+		if got := escapeMarkdown(text); got != want {
+			t.Errorf("escapeMarkdown(%q) = %q, ожидалось %q", text, got, want)
+		}
+	}
+}
+
+func TestPromoNoticeEscapesCode(t *testing.T) {
+	got := promoNotice(&db.PromoCode{Code: "SUMMER_SALE", Percent: 10})
+	want := "🎟 Промокод SUMMER\\_SALE: скидка 10%\n"
+	if got != want {
+		t.Errorf("promoNotice() = %q, ожидалось %q", got, want)
+	}
+	if promoNotice(nil) != "" {
+		t.Errorf("promoNotice(nil) должен быть пустым")
+	}
+}
+
+func TestPaymentChoice(t *testing.T) {
+	tests := []struct {
+		parts                                 []string
+		wantSource, wantMethod, wantAutoRenew string
+	}{
+		{nil, "", "", ""},
+		{[]string{payByBalance}, payByBalance, "", ""},
+		{[]string{payByCard, "sbp"}, payByCard, "sbp", ""},
+		{[]string{payByCard, "card", autoRenewOn}, payByCard, "card", autoRenewOn},
+	}
+	for _, tt := range tests {
+		source, method, autoRenew := paymentChoice(tt.parts)
+		if source != tt.wantSource || method != tt.wantMethod || autoRenew != tt.wantAutoRenew {
+			t.Errorf("paymentChoice(%q) = %q, %q, %q, ожидалось %q, %q, %q",
+				tt.parts, source, method, autoRenew, tt.wantSource, tt.wantMethod, tt.wantAutoRenew)
+		}
+	}
+}
+
+func TestSavesRenewalPaymentMethod(t *testing.T) {
+	t.Setenv("YOOKASSA_PAYMENT_METHODS", "card,sbp")
+	tests := []struct {
+		name         string
+		subscription db.Subscription
+		method       string
+		want         bool
+	}{
+		{"карта при включенном автопродлении", db.Subscription{AutoRenew: true}, "card", true},
+		{"СБП не сохраняется", db.Subscription{AutoRenew: true}, "sbp", false},
+		{"автопродление выключено", db.Subscription{}, "card", false},
+		{"карта уже сохранена", db.Subscription{AutoRenew: true, PaymentMethodID: "pm-1"}, "card", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := savesRenewalPaymentMethod(tt.subscription, tt.method); got != tt.want {
+				t.Errorf("savesRenewalPaymentMethod() = %v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
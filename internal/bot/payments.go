@@ -1,81 +1,276 @@
 package bot
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"gorm.io/gorm"
 	"vpn-bot/internal/db"
 	"vpn-bot/internal/services"
 )
 
+// Источники оплаты подписки.
+const (
+	payByCard    = "card"    // Полностью картой через Юкассу
+	payByBalance = "balance" // С баланса, а остаток – картой
+)
+
+// Выбор автопродления при покупке подписки.
+const (
+	autoRenewOn  = "on"
+	autoRenewOff = "off"
+)
+
 // reserveKeyAndCreatePayment резервирует VLESS-ключ и инициирует создание платежа через Юкассу.
-func reserveKeyAndCreatePayment(bot *tgbotapi.BotAPI, chatID int64, serverID, months int) {
-	// Поиск свободного ключа, который не используется и не зарезервирован.
-	var key db.VLESSKey
-	err := db.DB.
-		Where("server_id = ? AND is_used = false AND (reserved_until IS NULL OR reserved_until < NOW())", serverID).
-		First(&key).Error
+// source задаёт источник оплаты, method – код способа оплаты в Юкассе, autoRenew – выбор
+// автопродления; пустые значения означают, что пользователь их ещё не выбрал.
+func reserveKeyAndCreatePayment(bot *tgbotapi.BotAPI, chatID int64, user *db.User, serverID, planID int, source, method, autoRenew string) {
+	// Тарифный план – единственный источник срока и стоимости подписки.
+	plan, err := services.FindPlan(serverID, planID)
 	if err != nil {
-		msg := tgbotapi.NewMessage(chatID, "К сожалению, на данном сервере нет доступных ключей 😞")
-		bot.Send(msg)
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка: выбранный тариф недоступен."))
 		return
 	}
 
-	// Резервирование ключа на 5 минут
-	reservedUntil := time.Now().Add(5 * time.Minute)
-	if err := db.DB.Model(&key).Update("reserved_until", reservedUntil).Error; err != nil {
-		log.Printf("🔴 Ошибка резервирования ключа: %v", err)
-		msg := tgbotapi.NewMessage(chatID, "Ошибка при резервировании ключа. Попробуйте позже.")
-		bot.Send(msg)
+	// Стоимость подписки берётся из тарифного плана с учётом персональной скидки и промокода
+	quote := services.QuotePlan(user, serverID, *plan, sessionPromo(user))
+	if source == "" && askPaymentSource(bot, chatID, user, quote, fmt.Sprintf("buy_%d_%d", serverID, planID)) {
 		return
 	}
+	if paysByCard(user, quote, source) {
+		if method == "" && askPaymentMethod(bot, chatID, fmt.Sprintf("buy_%d_%d_%s", serverID, planID, onlineSource(source))) {
+			return
+		}
+		// Автопродление предлагается сразу при покупке: способ оплаты сохраняется из первого платежа.
+		paymentMethod := services.EnabledPaymentMethod(method)
+		if autoRenew == "" && paymentMethod.Recurring &&
+			askAutoRenew(bot, chatID, fmt.Sprintf("buy_%d_%d_%s_%s", serverID, planID, onlineSource(source), paymentMethod.Code)) {
+			return
+		}
+		// Для оплаты через Юкассу нужен контакт, на который она отправит чек.
+		if !ensureReceiptContact(bot, chatID, user, func(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+			reserveKeyAndCreatePayment(bot, chatID, user, serverID, planID, source, method, autoRenew)
+		}) {
+			return
+		}
+	}
 
-	// Получаем информацию о сервере для расчета цены
-	var server db.Server
-	if err := db.DB.First(&server, serverID).Error; err != nil {
-		msg := tgbotapi.NewMessage(chatID, "Ошибка: сервер не найден.")
+	// Атомарно резервируем свободный ключ за пользователем. 5 минут даются на создание платежа,
+	// после чего ключ остаётся за пользователем, пока платеж не оплачен или не отменён.
+	key, err := services.ReserveKey(serverID, user.ID, 5*time.Minute)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		msg := tgbotapi.NewMessage(chatID, "К сожалению, на данном сервере нет доступных ключей 😞")
+		bot.Send(msg)
+		return
+	} else if err != nil {
+		log.Printf("🔴 Ошибка резервирования ключа: %v", err)
+		msg := tgbotapi.NewMessage(chatID, "Ошибка при резервировании ключа. Попробуйте позже.")
 		bot.Send(msg)
 		return
 	}
 
-	// Расчет стоимости подписки
-	// 🔴 ! Убедитесь, что в БД для сервера Price1 задан базовый тариф (например, 500₽)
-	price := server.Price1 * float64(months)
-	if months == 3 {
-		price *= 0.95
-	} else if months == 6 {
-		price *= 0.90
-	} else if months == 12 {
-		price *= 0.85
+	// Создаем платеж и записываем его в БД
+	payment := db.Payment{
+		UserID:        user.ID,
+		Kind:          db.PaymentKindSubscription,
+		ServerID:      serverID,
+		ReservedKeyID: &key.ID,
+		PlanID:        &plan.ID,
+		Months:        plan.Months,
+		// Юкасса сохранит способ оплаты, и после оплаты для подписки включится автопродление.
+		SavePaymentMethod: autoRenew == autoRenewOn,
 	}
-
-	// Создаем платеж через Юкассу
-	paymentID, paymentURL, err := services.CreateYooKassaPayment(chatID, price)
+	paymentURL, err := checkout(user, &payment, quote, source == payByBalance, method)
 	if err != nil {
 		log.Printf("🔴 Ошибка создания платежа: %v", err)
-		msg := tgbotapi.NewMessage(chatID, "Ошибка при создании платежа. Попробуйте позже.")
-		bot.Send(msg)
+		cancelKeyReservation(key.ID)
+		sendCheckoutError(bot, chatID, err)
 		return
 	}
 
-	// Записываем платеж в БД
-	payment := db.Payment{
-		UserID:     int(chatID), // 🔴 ! Убедитесь, что Telegram ID корректно конвертируется в int
-		YooKassaID: paymentID,
-		Amount:     price,
-		Status:     "pending",
-	}
-	if err := db.DB.Create(&payment).Error; err != nil {
-		log.Printf("🔴 Ошибка записи платежа в БД: %v", err)
-		msg := tgbotapi.NewMessage(chatID, "Ошибка при записи платежа. Попробуйте позже.")
-		bot.Send(msg)
+	// Оплата полностью с баланса – сразу выдаём ключ
+	if paymentURL == "" {
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Подписка оплачена с баланса: %s", priceText(quote))))
+		completeBalancePayment(bot, chatID, &payment)
 		return
 	}
 
 	// Информируем пользователя
-	text := fmt.Sprintf("✅ Ваш VLESS-ключ зарезервирован!\n💰 Сумма: %.2f₽\n\nПерейдите по ссылке для оплаты:\n%s", price, paymentURL)
+	text := fmt.Sprintf("✅ Ваш VLESS-ключ зарезервирован!\n💰 Сумма: %s%s\n\nПерейдите по ссылке для оплаты:\n%s", priceText(quote), balancePartText(payment), paymentURL)
 	msg := tgbotapi.NewMessage(chatID, text)
 	bot.Send(msg)
 }
+
+// completeBalancePayment исполняет платеж, полностью оплаченный с баланса. Если исполнить его
+// не удалось, платеж отменяется: средства возвращаются на баланс, а резервирование ключа снимается.
+// Если не удалась и отмена, платеж отменит проверка зависших платежей.
+func completeBalancePayment(bot *tgbotapi.BotAPI, chatID int64, payment *db.Payment) {
+	_, err := services.ApplyPaymentStatus(payment, db.PaymentSucceeded)
+	if err == nil {
+		return
+	}
+	log.Printf("🔴 %v", err)
+
+	// Об отмене и возврате средств пользователя уведомит обработка отменённого платежа.
+	if _, err := services.ApplyPaymentStatus(payment, db.PaymentCanceled); err != nil {
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Оформить заказ не удалось. Списанные с баланса средства будут возвращены автоматически в течение нескольких минут."))
+	}
+}
+
+// askPaymentSource предлагает оплатить подписку с баланса, если на нём есть средства.
+// К callbackPrefix добавляется выбранный источник оплаты. Возвращает false, если выбирать
+// не из чего и можно сразу оплачивать картой.
+func askPaymentSource(bot *tgbotapi.BotAPI, chatID int64, user *db.User, quote services.Quote, callbackPrefix string) bool {
+	if user.Balance <= 0 {
+		return false
+	}
+
+	balanceLabel := "💰 Оплатить с баланса"
+	if user.Balance < quote.FinalPrice {
+		balanceLabel = fmt.Sprintf("💰 Баланс + карта (%.2f₽ картой)", quote.FinalPrice-user.Balance)
+	}
+	text := fmt.Sprintf("💰 Сумма: %s\nНа вашем балансе %.2f₽. Выберите способ оплаты:", priceText(quote), user.Balance)
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(balanceLabel, callbackPrefix+"_"+payByBalance)),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("💳 Оплатить картой", callbackPrefix+"_"+payByCard)),
+	)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("🔴 Ошибка отправки выбора способа оплаты: %v", err)
+	}
+	return true
+}
+
+// askAutoRenew предлагает включить автопродление покупаемой подписки. К callbackPrefix
+// добавляется autoRenewOn или autoRenewOff.
+func askAutoRenew(bot *tgbotapi.BotAPI, chatID int64, callbackPrefix string) bool {
+	text := "🔁 Включить автопродление? Мы сохраним способ оплаты и будем продлевать подписку автоматически " +
+		"незадолго до окончания срока. Отключить автопродление можно в любой момент в разделе «Мои подписки»."
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("✅ Да, продлевать автоматически", callbackPrefix+"_"+autoRenewOn)),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Нет, продлю вручную", callbackPrefix+"_"+autoRenewOff)),
+	)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("🔴 Ошибка отправки выбора автопродления: %v", err)
+	}
+	return true
+}
+
+// askPaymentMethod предлагает выбрать способ оплаты в Юкассе, если включено больше одного.
+// К callbackPrefix добавляется код выбранного способа. Возвращает false, если выбирать не из чего.
+func askPaymentMethod(bot *tgbotapi.BotAPI, chatID int64, callbackPrefix string) bool {
+	methods := services.EnabledPaymentMethods()
+	if len(methods) < 2 {
+		return false
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, method := range methods {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(method.Label, callbackPrefix+"_"+method.Code),
+		))
+	}
+	msg := tgbotapi.NewMessage(chatID, "Выберите способ оплаты:")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("🔴 Ошибка отправки выбора способа оплаты: %v", err)
+	}
+	return true
+}
+
+// onlineSource возвращает источник оплаты для callback-данных выбора способа оплаты:
+// если пользователь не выбирал источник, оплата идёт полностью через Юкассу.
+func onlineSource(source string) string {
+	if source == "" {
+		return payByCard
+	}
+	return source
+}
+
+// checkout списывает с баланса доступную часть суммы (если useBalance), на остаток создаёт
+// платеж в Юкассе способом оплаты method и записывает платеж в БД. Возвращает ссылку на оплату;
+// пустая ссылка означает, что платеж полностью оплачен с баланса и его нужно исполнить
+// через completeBalancePayment.
+func checkout(user *db.User, payment *db.Payment, quote services.Quote, useBalance bool, method string) (string, error) {
+	price := quote.FinalPrice
+	var balancePart float64
+	if useBalance {
+		balancePart = math.Min(user.Balance, price)
+		// Юкасса не принимает платежи меньше рубля – оставляем на карту не меньше этой суммы.
+		if cardPart := price - balancePart; cardPart > 0 && cardPart < 1 {
+			balancePart = math.Max(price-1, 0)
+		}
+	}
+	cardPart := math.Round((price-balancePart)*100) / 100
+
+	paymentURL := ""
+	if cardPart > 0 {
+		receipt, err := services.PaymentReceipt(user, *payment, cardPart)
+		if err != nil {
+			return "", err
+		}
+		paymentID, url, err := services.CreateYooKassaPayment(user.ID, cardPart, services.PaymentMethodType(method), payment.SavePaymentMethod, receipt)
+		if err != nil {
+			return "", err
+		}
+		payment.YooKassaID = paymentID
+		payment.Status = db.PaymentPending
+		payment.ReceiptStatus = services.ReceiptPending
+		paymentURL = url
+	} else {
+		payment.YooKassaID = services.BalancePaymentID(user.ID)
+		payment.Status = db.PaymentPending
+	}
+	payment.Amount = cardPart
+	payment.BalanceAmount = balancePart
+
+	// Платеж записывается вместе со списанием с баланса и применением промокода
+	if err := services.CreateBalancePayment(payment, quote); err != nil {
+		if isPromoRejection(err) {
+			clearPromoCode(user)
+		}
+		return "", err
+	}
+	clearPromoCode(user)
+	return paymentURL, nil
+}
+
+// balancePartText возвращает пояснение о списанной с баланса части суммы или пустую строку.
+func balancePartText(payment db.Payment) string {
+	if payment.BalanceAmount <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n💰 Списано с баланса: %.2f₽, к оплате картой: %.2f₽", payment.BalanceAmount, payment.Amount)
+}
+
+// sendCheckoutError сообщает пользователю о неудачном создании платежа.
+func sendCheckoutError(bot *tgbotapi.BotAPI, chatID int64, err error) {
+	if errors.Is(err, services.ErrInsufficientBalance) {
+		bot.Send(tgbotapi.NewMessage(chatID, "Недостаточно средств на балансе. Попробуйте оплатить картой."))
+		return
+	}
+	if isPromoRejection(err) {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ К сожалению, "+err.Error()+". Выберите тариф заново, чтобы оплатить без промокода."))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при создании платежа. Попробуйте позже."))
+}
+
+// cancelKeyReservation снимает резервирование ключа, если платеж под него так и не был создан.
+func cancelKeyReservation(keyID int) {
+	if err := db.DB.Model(&db.VLESSKey{}).
+		Where("id = ? AND is_used = false", keyID).
+		Updates(map[string]interface{}{
+			"reserved_until": nil,
+			"user_id":        nil,
+		}).Error; err != nil {
+		log.Printf("🔴 Ошибка снятия резервирования ключа %d: %v", keyID, err)
+	}
+}
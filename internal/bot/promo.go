@@ -0,0 +1,110 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// promoRejections – ошибки проверки промокода, текст которых можно показать пользователю.
+var promoRejections = []error{
+	services.ErrPromoNotFound,
+	services.ErrPromoExpired,
+	services.ErrPromoExhausted,
+	services.ErrPromoUserLimit,
+	services.ErrPromoNotAllowed,
+	services.ErrPromoInactive,
+}
+
+// isPromoRejection проверяет, что промокод отклонён по бизнес-правилам, а не из-за сбоя.
+func isPromoRejection(err error) bool {
+	for _, rejection := range promoRejections {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionPromo возвращает промокод, применённый пользователем, если он всё ещё действует.
+func sessionPromo(user *db.User) *db.PromoCode {
+	code := promoCode(user)
+	if code == "" {
+		return nil
+	}
+	promo, err := services.FindPromoCode(user, code)
+	if err != nil {
+		if !isPromoRejection(err) {
+			log.Printf("🔴 %v", err)
+		}
+		clearPromoCode(user)
+		return nil
+	}
+	return promo
+}
+
+// requestPromoCode просит пользователя ввести промокод. После ввода заново показываются
+// тарифы сервера serverID (если он задан) с пересчитанными ценами.
+func requestPromoCode(bot *tgbotapi.BotAPI, chatID int64, user *db.User, serverID int) {
+	awaitInput(user, func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message) {
+		applyPromoCode(bot, message.Chat.ID, user, message.Text, serverID)
+	})
+	bot.Send(tgbotapi.NewMessage(chatID, "🎟 Введите промокод:"))
+}
+
+// applyPromoCode проверяет промокод и запоминает его для следующей покупки или продления.
+func applyPromoCode(bot *tgbotapi.BotAPI, chatID int64, user *db.User, code string, serverID int) {
+	promo, err := services.FindPromoCode(user, code)
+	if err != nil {
+		if isPromoRejection(err) {
+			bot.Send(tgbotapi.NewMessage(chatID, "⚠️ К сожалению, "+err.Error()+"."))
+		} else {
+			log.Printf("🔴 %v", err)
+			bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при проверке промокода. Попробуйте позже."))
+		}
+		return
+	}
+
+	if serverID > 0 && !promoAppliesToServer(promo, serverID) {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ К сожалению, "+services.ErrPromoNotAllowed.Error()+"."))
+		return
+	}
+
+	setPromoCode(user, promo.Code)
+	text := fmt.Sprintf("✅ Промокод %s применён: %s.", promo.Code, promoDiscountText(promo))
+	if serverID == 0 {
+		text += " Скидка будет учтена при следующей покупке или продлении."
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, text))
+	if serverID > 0 {
+		sendTariffSelection(bot, chatID, user, serverID)
+	}
+}
+
+// promoAppliesToServer проверяет, действует ли промокод хотя бы для одного тарифа сервера.
+func promoAppliesToServer(promo *db.PromoCode, serverID int) bool {
+	plans, err := services.ActivePlans(serverID)
+	if err != nil {
+		log.Printf("🔴 %v", err)
+		return false
+	}
+	for _, plan := range plans {
+		if services.PromoApplies(promo, serverID, plan.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// promoDiscountText описывает размер скидки по промокоду.
+func promoDiscountText(promo *db.PromoCode) string {
+	if promo.Percent > 0 {
+		return fmt.Sprintf("скидка %d%%", promo.Percent)
+	}
+	return fmt.Sprintf("скидка %.0f₽", promo.Amount)
+}
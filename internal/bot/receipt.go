@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// receiptContinuation продолжает прерванное действие после того, как пользователь указал контакт для чека.
+type receiptContinuation func(bot *tgbotapi.BotAPI, chatID int64, user *db.User)
+
+// ensureReceiptContact проверяет, что у пользователя указан email или телефон для чека.
+// Если контакта нет, запрашивает его и после ввода вызывает next. Возвращает true,
+// если контакт уже есть и действие можно продолжать сразу.
+func ensureReceiptContact(bot *tgbotapi.BotAPI, chatID int64, user *db.User, next receiptContinuation) bool {
+	if services.HasReceiptContact(user) {
+		return true
+	}
+	requestReceiptContact(bot, chatID, user, next)
+	return false
+}
+
+// requestReceiptContact просит пользователя ввести email или телефон для отправки чеков.
+// next может быть nil, если после ввода ничего продолжать не нужно.
+func requestReceiptContact(bot *tgbotapi.BotAPI, chatID int64, user *db.User, next receiptContinuation) {
+	awaitInput(user, func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message) {
+		if err := services.SetReceiptContact(user, message.Text); err != nil {
+			if errors.Is(err, services.ErrInvalidReceiptContact) {
+				bot.Send(tgbotapi.NewMessage(message.Chat.ID, "⚠️ Не удалось распознать email или телефон. Попробуйте ещё раз."))
+				requestReceiptContact(bot, message.Chat.ID, user, next)
+				return
+			}
+			log.Printf("🔴 %v", err)
+			bot.Send(tgbotapi.NewMessage(message.Chat.ID, "Ошибка при сохранении контакта. Попробуйте позже."))
+			return
+		}
+
+		bot.Send(tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf("✅ Чеки будут приходить на %s.", services.ReceiptContact(user))))
+		if next != nil {
+			next(bot, message.Chat.ID, user)
+		}
+	})
+	bot.Send(tgbotapi.NewMessage(chatID, "🧾 По закону мы отправляем чек о каждой оплате. Введите email или номер телефона для получения чеков:"))
+}
+
+// sendReceiptContact показывает текущий контакт для чеков и предлагает его изменить.
+func sendReceiptContact(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("🧾 Контакт для чеков: %s", services.ReceiptContact(user))))
+	requestReceiptContact(bot, chatID, user, nil)
+}
+
+// paysByCard сообщает, будет ли часть суммы оплачиваться картой через Юкассу.
+func paysByCard(user *db.User, quote services.Quote, source string) bool {
+	return source != payByBalance || user.Balance < quote.FinalPrice
+}
@@ -0,0 +1,51 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// registerReferral привязывает пользователя к пригласившему по параметру /start.
+func registerReferral(bot *tgbotapi.BotAPI, chatID int64, user *db.User, startParam string) {
+	registered, err := services.RegisterReferral(user, startParam)
+	if err != nil {
+		log.Printf("🔴 %v", err)
+		return
+	}
+	if registered {
+		bot.Send(tgbotapi.NewMessage(chatID, "👋 Вы пришли по приглашению друга! После оформления подписки он получит бонусные дни."))
+	}
+}
+
+// sendReferralInfo отправляет пользователю его реферальную ссылку и статистику приглашений.
+func sendReferralInfo(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+	stats, err := services.GetReferralStats(user)
+	if err != nil {
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при получении статистики приглашений. Попробуйте позже."))
+		return
+	}
+
+	text := fmt.Sprintf(
+		"👥 Приглашайте друзей и получайте бонусные дни подписки за каждого, кто оформит подписку!\n\n"+
+			"🔗 Ваша ссылка:\n%s\n\n"+
+			"📈 Приглашено: %d\n💳 Оформили подписку: %d\n🎁 Получено бонусных дней: %d",
+		services.ReferralLink(bot.Self.UserName, user), stats.Invited, stats.Rewarded, stats.BonusDays,
+	)
+	if stats.BonusAmount > 0 {
+		text += fmt.Sprintf("\n💰 Зачислено на баланс: %.2f₽", stats.BonusAmount)
+	}
+	if user.BonusDays > 0 {
+		text += fmt.Sprintf("\n⏳ Ожидают начисления: %d (добавятся к следующей подписке)", user.BonusDays)
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.DisableWebPagePreview = true
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("🔴 Ошибка отправки реферальной информации: %v", err)
+	}
+}
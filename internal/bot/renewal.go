@@ -0,0 +1,185 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// sendRenewSelection отправляет пользователю список его подписок, доступных для продления.
+func sendRenewSelection(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+	var subscriptions []db.Subscription
+	err := db.DB.Preload("Server").
+		Where("user_id = ? AND status IN ?", user.ID, []string{db.SubscriptionActive, db.SubscriptionExpired}).
+		Order("expires_at").
+		Find(&subscriptions).Error
+	if err != nil {
+		log.Printf("🔴 Ошибка получения подписок пользователя %d: %v", user.ID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при получении подписок. Попробуйте позже."))
+		return
+	}
+
+	if len(subscriptions) == 0 {
+		msg := tgbotapi.NewMessage(chatID, "У вас нет подписок для продления. Оформить подписку можно через «🚀 Купить подписку».")
+		bot.Send(msg)
+		return
+	}
+
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, subscription := range subscriptions {
+		label := fmt.Sprintf("%s – до %s", subscription.Server.Name, subscription.ExpiresAt.Format("02.01.2006"))
+		if subscription.Status == db.SubscriptionExpired {
+			label = fmt.Sprintf("%s – истекла %s", subscription.Server.Name, subscription.ExpiresAt.Format("02.01.2006"))
+		}
+		btn := tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("renew_%d", subscription.ID))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+	}
+	msg := tgbotapi.NewMessage(chatID, "Выберите подписку для продления:")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("🔴 Ошибка отправки выбора подписки для продления: %v", err)
+	}
+}
+
+// findUserSubscription загружает подписку вместе с сервером, проверяя, что она принадлежит пользователю.
+func findUserSubscription(user *db.User, subscriptionID int) (db.Subscription, error) {
+	var subscription db.Subscription
+	err := db.DB.Preload("Server").
+		Where("id = ? AND user_id = ?", subscriptionID, user.ID).
+		First(&subscription).Error
+	return subscription, err
+}
+
+// checkRenewable сообщает пользователю, если подписку нельзя продлить. Возвращает false в этом случае.
+func checkRenewable(bot *tgbotapi.BotAPI, chatID int64, subscription db.Subscription) bool {
+	err := services.CheckRenewable(subscription)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, services.ErrSubscriptionRevoked) {
+		bot.Send(tgbotapi.NewMessage(chatID, "❌ Эта подписка отозвана и не может быть продлена. Оформите новую через «🚀 Купить подписку»."))
+	} else {
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при проверке подписки. Попробуйте позже."))
+	}
+	return false
+}
+
+// sendRenewTariffSelection отправляет пользователю выбор срока продления подписки.
+func sendRenewTariffSelection(bot *tgbotapi.BotAPI, chatID int64, user *db.User, subscriptionID int) {
+	subscription, err := findUserSubscription(user, subscriptionID)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка: подписка не найдена."))
+		return
+	}
+	if !checkRenewable(bot, chatID, subscription) {
+		return
+	}
+
+	plans, err := services.ActivePlans(subscription.ServerID)
+	if err != nil {
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при получении тарифов."))
+		return
+	}
+	if len(plans) == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "Для этого сервера пока нет доступных тарифов 😞"))
+		return
+	}
+
+	promo := sessionPromo(user)
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, plan := range plans {
+		btn := tgbotapi.NewInlineKeyboardButtonData(planButtonLabel(services.QuotePlan(user, subscription.ServerID, plan, promo)), fmt.Sprintf("renew_%d_%d", subscription.ID, plan.ID))
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(btn))
+	}
+
+	text := fmt.Sprintf(
+		"Продление подписки на сервер *%s* (действует до %s).\n%s%sВыберите срок продления:",
+		subscription.Server.Name, subscription.ExpiresAt.Format("02.01.2006"), discountNotice(user), promoNotice(promo),
+	)
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	if _, err := bot.Send(msg); err != nil {
+		log.Printf("🔴 Ошибка отправки выбора срока продления: %v", err)
+	}
+}
+
+// createRenewalPayment создаёт платеж продления подписки. Новый ключ не резервируется –
+// после оплаты продлевается срок существующей подписки. source – источник оплаты, как в reserveKeyAndCreatePayment.
+func createRenewalPayment(bot *tgbotapi.BotAPI, chatID int64, user *db.User, subscriptionID, planID int, source, method string) {
+	subscription, err := findUserSubscription(user, subscriptionID)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка: подписка не найдена."))
+		return
+	}
+	if !checkRenewable(bot, chatID, subscription) {
+		return
+	}
+
+	plan, err := services.FindPlan(subscription.ServerID, planID)
+	if err != nil {
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка: выбранный тариф недоступен."))
+		return
+	}
+	quote := services.QuotePlan(user, subscription.ServerID, *plan, sessionPromo(user))
+	if source == "" && askPaymentSource(bot, chatID, user, quote, fmt.Sprintf("renew_%d_%d", subscriptionID, planID)) {
+		return
+	}
+	if paysByCard(user, quote, source) {
+		if method == "" && askPaymentMethod(bot, chatID, fmt.Sprintf("renew_%d_%d_%s", subscriptionID, planID, onlineSource(source))) {
+			return
+		}
+		// Для оплаты через Юкассу нужен контакт, на который она отправит чек.
+		if !ensureReceiptContact(bot, chatID, user, func(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+			createRenewalPayment(bot, chatID, user, subscriptionID, planID, source, method)
+		}) {
+			return
+		}
+	}
+
+	// Создаем платеж и записываем его в БД
+	payment := db.Payment{
+		UserID:            user.ID,
+		Kind:              db.PaymentKindSubscription,
+		ServerID:          subscription.ServerID,
+		SubscriptionID:    &subscription.ID,
+		PlanID:            &plan.ID,
+		Months:            plan.Months,
+		SavePaymentMethod: savesRenewalPaymentMethod(subscription, method),
+	}
+	paymentURL, err := checkout(user, &payment, quote, source == payByBalance, method)
+	if err != nil {
+		log.Printf("🔴 Ошибка создания платежа продления: %v", err)
+		sendCheckoutError(bot, chatID, err)
+		return
+	}
+
+	// Оплата полностью с баланса – сразу продлеваем подписку
+	if paymentURL == "" {
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Продление оплачено с баланса: %s", priceText(quote))))
+		completeBalancePayment(bot, chatID, &payment)
+		return
+	}
+
+	text := fmt.Sprintf(
+		"🔄 Продление подписки на сервер %s на %s.\n💰 Сумма: %s%s\n\nПерейдите по ссылке для оплаты:\n%s",
+		subscription.Server.Name, services.MonthsLabel(plan.Months), priceText(quote), balancePartText(payment), paymentURL,
+	)
+	bot.Send(tgbotapi.NewMessage(chatID, text))
+}
+
+// savesRenewalPaymentMethod сообщает, нужно ли при оплате продления просить Юкассу сохранить
+// способ оплаты: автопродление включено, сохранённой карты нет, а выбранный способ оплаты
+// поддерживает повторные списания.
+func savesRenewalPaymentMethod(subscription db.Subscription, method string) bool {
+	return subscription.AutoRenew && subscription.PaymentMethodID == "" &&
+		services.EnabledPaymentMethod(method).Recurring
+}
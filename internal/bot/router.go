@@ -0,0 +1,239 @@
+package bot
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/handlers"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// commandHandler обрабатывает команду пользователя user. args – текст после имени команды
+// (например, "текст" для "/broadcast текст"), для кнопок клавиатуры он пустой.
+type commandHandler func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string)
+
+// command описывает команду бота: slash-команды и подписи кнопок, которые её вызывают.
+type command struct {
+	names   []string
+	handler commandHandler
+}
+
+// commands – единая таблица регистрации команд. Чтобы добавить команду,
+// достаточно добавить сюда запись с её именами и обработчиком.
+var commands = []command{
+	{
+		names: []string{"/start"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			// Параметр deep link: /start ref_<код> – переход по реферальной ссылке
+			if args != "" {
+				registerReferral(bot, message.Chat.ID, user, args)
+			}
+			sendStartMenu(bot, message.Chat.ID, user)
+		},
+	},
+	{
+		names: []string{"/buy", "🚀 Купить подписку"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			// Отправляем выбор сервера для покупки подписки
+			sendServerSelection(bot, message.Chat.ID, "select_server_")
+		},
+	},
+	{
+		names: []string{"/renew", "🔄 Продлить подписку"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			sendRenewSelection(bot, message.Chat.ID, user)
+		},
+	},
+	{
+		names: []string{"/subscriptions", "📊 Мои подписки"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			sendMySubscriptions(bot, message.Chat.ID, user)
+		},
+	},
+	{
+		names: []string{"/support", "📨 Поддержка"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			sendSupportInfo(bot, message.Chat.ID)
+		},
+	},
+	{
+		names: []string{"/trial", "🎁 Пробный период"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			sendTrialOffer(bot, message.Chat.ID, user)
+		},
+	},
+	{
+		names: []string{"/referral", "👥 Пригласить друга"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			sendReferralInfo(bot, message.Chat.ID, user)
+		},
+	},
+	{
+		names: []string{"/balance", "💰 Баланс"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			sendBalance(bot, message.Chat.ID, user)
+		},
+	},
+	{
+		names: []string{"/receipt"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			sendReceiptContact(bot, message.Chat.ID, user)
+		},
+	},
+	{
+		names: []string{"/promo"},
+		handler: func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			// Формат команды: /promo <промокод>
+			if args == "" {
+				requestPromoCode(bot, message.Chat.ID, user, 0)
+				return
+			}
+			applyPromoCode(bot, message.Chat.ID, user, args, 0)
+		},
+	},
+
+	// Команды администратора
+	{
+		names: []string{"/listservers"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.ListServersHandler(bot, message.Chat.ID)
+		}),
+	},
+	{
+		names: []string{"/broadcast"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			// Формат команды: /broadcast <сообщение>
+			if args == "" {
+				bot.Send(tgbotapi.NewMessage(message.Chat.ID, "⚠️ Использование: /broadcast <сообщение>"))
+				return
+			}
+			handlers.BroadcastHandler(bot, message.Chat.ID, args)
+		}),
+	},
+	{
+		names: []string{"/discount"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.DiscountHandler(bot, message.Chat.ID, args)
+		}),
+	},
+	{
+		names: []string{"/revokediscount"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.RevokeDiscountHandler(bot, message.Chat.ID, args)
+		}),
+	},
+	{
+		names: []string{"/addpromo"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.AddPromoHandler(bot, message.Chat.ID, args)
+		}),
+	},
+	{
+		names: []string{"/addbalance"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.AdjustBalanceHandler(bot, message.Chat.ID, args)
+		}),
+	},
+	{
+		names: []string{"/refund"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.RefundHandler(bot, message.Chat.ID, args)
+		}),
+	},
+	{
+		names: []string{"/webhooks"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.WebhookEventsHandler(bot, message.Chat.ID)
+		}),
+	},
+	{
+		names: []string{"/replaywebhook"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.ReplayWebhookHandler(bot, message.Chat.ID, args)
+		}),
+	},
+	{
+		names: []string{"/reissuekey"},
+		handler: adminOnly(func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+			handlers.ReissueKeyHandler(bot, message.Chat.ID, args)
+		}),
+	},
+}
+
+// getAdminID получает ID администратора из переменной окружения.
+func getAdminID() (int64, error) {
+	adminIDStr := os.Getenv("ADMIN_TELEGRAM_ID") // 🔴 ! Убедитесь, что ADMIN_TELEGRAM_ID заполнена корректно!
+	return strconv.ParseInt(adminIDStr, 10, 64)
+}
+
+// adminOnly – middleware, пропускающий к обработчику только администратора бота.
+func adminOnly(next commandHandler) commandHandler {
+	return func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message, args string) {
+		adminID, err := getAdminID()
+		if err != nil {
+			log.Printf("🔴 Ошибка преобразования ADMIN_TELEGRAM_ID: %v", err)
+		}
+		if err != nil || message.From == nil || int64(message.From.ID) != adminID {
+			bot.Send(tgbotapi.NewMessage(message.Chat.ID, "⛔ Доступ запрещён"))
+			return
+		}
+		next(bot, user, message, args)
+	}
+}
+
+// commandIndex – индекс обработчиков по имени команды или подписи кнопки.
+var commandIndex = buildCommandIndex(commands)
+
+// buildCommandIndex строит индекс обработчиков из таблицы команд.
+func buildCommandIndex(commands []command) map[string]commandHandler {
+	index := make(map[string]commandHandler)
+	for _, cmd := range commands {
+		for _, name := range cmd.names {
+			if _, exists := index[name]; exists {
+				panic("🔴 Команда зарегистрирована дважды: " + name)
+			}
+			index[name] = cmd.handler
+		}
+	}
+	return index
+}
+
+// parseCommand разбирает текст сообщения на имя команды и её аргументы.
+// Подпись кнопки возвращается целиком, у slash-команды отбрасывается суффикс @имя_бота.
+func parseCommand(text string) (name, args string) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return text, ""
+	}
+
+	name = text
+	if i := strings.IndexAny(text, " \n\t"); i >= 0 {
+		name, args = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name), args
+}
+
+// routeMessage находит обработчик для текстового сообщения и вызывает его.
+func routeMessage(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message) {
+	name, args := parseCommand(message.Text)
+	handler, ok := commandIndex[name]
+	if !ok {
+		// Сообщение может быть ответом на запрос бота (например, ввод промокода)
+		if input, ok := takePendingInput(user); ok {
+			input(bot, user, message)
+			return
+		}
+		sendUnknownCommand(bot, message.Chat.ID)
+		return
+	}
+	// Пользователь выбрал другую команду – ожидаемый ввод больше не нужен
+	cancelPendingInput(user)
+	handler(bot, user, message, args)
+}
@@ -0,0 +1,37 @@
+package bot
+
+import "testing"
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text     string
+		wantName string
+		wantArgs string
+	}{
+		{"/start", "/start", ""},
+		{"  /START  ", "/start", ""},
+		{"/start ref_abc", "/start", "ref_abc"},
+		{"/start@vpn_bot ref_abc", "/start", "ref_abc"},
+		{"/broadcast  многострочный\nтекст ", "/broadcast", "многострочный\nтекст"},
+		{"/promo\nSUMMER", "/promo", "SUMMER"},
+		{"🚀 Купить подписку", "🚀 Купить подписку", ""},
+		{"  📊 Мои подписки ", "📊 Мои подписки", ""},
+		{"просто текст", "просто текст", ""},
+	}
+	for _, tt := range tests {
+		name, args := parseCommand(tt.text)
+		if name != tt.wantName || args != tt.wantArgs {
+			t.Errorf("parseCommand(%q) = (%q, %q), ожидалось (%q, %q)", tt.text, name, args, tt.wantName, tt.wantArgs)
+		}
+	}
+}
+
+func TestCommandIndexCoversAllNames(t *testing.T) {
+	for _, cmd := range commands {
+		for _, name := range cmd.names {
+			if parsed, _ := parseCommand(name); commandIndex[parsed] == nil {
+				t.Errorf("команда %q недоступна через parseCommand", name)
+			}
+		}
+	}
+}
@@ -11,10 +11,12 @@ import (
 func InitCronJobs() {
 	c := cron.New()
 
-	// 1. Проверка зависших платежей каждые 2 минуты.
+	// 1. Проверка зависших платежей, возвратов и чеков каждые 2 минуты.
 	_, err := c.AddFunc("*/2 * * * *", func() {
 		log.Println("🔍 Проверка зависших платежей...")
 		services.CheckPendingPayments()
+		services.CheckPendingRefunds()
+		services.CheckPendingReceipts()
 	})
 	if err != nil {
 		log.Printf("🔴 Ошибка добавления задачи проверки платежей: %v", err)
@@ -29,7 +31,24 @@ func InitCronJobs() {
 		log.Printf("🔴 Ошибка добавления задачи отправки уведомлений: %v", err)
 	}
 
-	// 3. (Опционально) Ежедневный мониторинг серверов, например, в 03:00 утра.
+	// 3. Ежедневное автопродление подписок с сохранённым способом оплаты в 09:00.
+	_, err = c.AddFunc("0 9 * * *", func() {
+		log.Println("🔁 Автопродление подписок...")
+		services.ProcessAutoRenewals()
+	})
+	if err != nil {
+		log.Printf("🔴 Ошибка добавления задачи автопродления: %v", err)
+	}
+
+	// 4. Повторная обработка уведомлений Юкассы из очереди каждую минуту.
+	_, err = c.AddFunc("* * * * *", func() {
+		services.ProcessWebhookEvents()
+	})
+	if err != nil {
+		log.Printf("🔴 Ошибка добавления задачи обработки уведомлений: %v", err)
+	}
+
+	// 5. (Опционально) Ежедневный мониторинг серверов, например, в 03:00 утра.
 	// 🔴 ! Если реализована функция MonitorServers, раскомментируйте и настройте задачу.
 	/*
 		_, err = c.AddFunc("0 3 * * *", func() {
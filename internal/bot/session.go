@@ -0,0 +1,68 @@
+package bot
+
+import (
+	"fmt"
+	"time"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/pkg/cache"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// sessionTTL – время жизни состояния диалога с пользователем.
+const sessionTTL = 30 * time.Minute
+
+// sessions хранит состояние диалогов: ожидаемый ввод и применённые промокоды.
+var sessions = cache.New()
+
+// inputHandler обрабатывает текст, который бот запросил у пользователя.
+type inputHandler func(bot *tgbotapi.BotAPI, user *db.User, message *tgbotapi.Message)
+
+// inputKey возвращает ключ ожидаемого ввода пользователя.
+func inputKey(userID int) string {
+	return fmt.Sprintf("input:%d", userID)
+}
+
+// promoKey возвращает ключ применённого пользователем промокода.
+func promoKey(userID int) string {
+	return fmt.Sprintf("promo:%d", userID)
+}
+
+// awaitInput запоминает, что следующее текстовое сообщение пользователя обрабатывает handler.
+func awaitInput(user *db.User, handler inputHandler) {
+	sessions.Set(inputKey(user.ID), handler, sessionTTL)
+}
+
+// takePendingInput возвращает и сбрасывает обработчик ожидаемого ввода пользователя.
+func takePendingInput(user *db.User) (inputHandler, bool) {
+	value, ok := sessions.Take(inputKey(user.ID))
+	if !ok {
+		return nil, false
+	}
+	return value.(inputHandler), true
+}
+
+// cancelPendingInput сбрасывает ожидаемый ввод, например когда пользователь выбрал другую команду.
+func cancelPendingInput(user *db.User) {
+	sessions.Delete(inputKey(user.ID))
+}
+
+// setPromoCode запоминает промокод, применённый пользователем к следующей покупке.
+func setPromoCode(user *db.User, code string) {
+	sessions.Set(promoKey(user.ID), code, sessionTTL)
+}
+
+// promoCode возвращает промокод, применённый пользователем, или пустую строку.
+func promoCode(user *db.User) string {
+	value, ok := sessions.Get(promoKey(user.ID))
+	if !ok {
+		return ""
+	}
+	return value.(string)
+}
+
+// clearPromoCode забывает применённый пользователем промокод.
+func clearPromoCode(user *db.User) {
+	sessions.Delete(promoKey(user.ID))
+}
@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// sendMySubscriptions отправляет пользователю список его действующих подписок.
+func sendMySubscriptions(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+	var subscriptions []db.Subscription
+	err := db.DB.Preload("Server").
+		Where("user_id = ? AND status = ?", user.ID, db.SubscriptionActive).
+		Order("expires_at").
+		Find(&subscriptions).Error
+	if err != nil {
+		log.Printf("🔴 Ошибка получения подписок пользователя %d: %v", user.ID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при получении подписок. Попробуйте позже."))
+		return
+	}
+
+	if len(subscriptions) == 0 {
+		msg := tgbotapi.NewMessage(chatID, "У вас пока нет активных подписок. Оформить подписку можно через «🚀 Купить подписку».")
+		bot.Send(msg)
+		return
+	}
+
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("📊 Ваши подписки (%d):", len(subscriptions))))
+
+	now := time.Now()
+	for _, subscription := range subscriptions {
+		daysLeft := int(subscription.ExpiresAt.Sub(now).Hours() / 24)
+		text := fmt.Sprintf(
+			"🌍 *%s*\n📅 Действует до: %s\n⏳ Осталось дней: %d\n🔁 Автопродление: %s",
+			subscription.Server.Name, subscription.ExpiresAt.Format("02.01.2006"), daysLeft, autoRenewStatus(subscription),
+		)
+		keyboard := tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔑 Показать ключ / QR", fmt.Sprintf("sub_key_%d", subscription.ID)),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("🔄 Продлить", fmt.Sprintf("renew_%d", subscription.ID)),
+				tgbotapi.NewInlineKeyboardButtonData("📨 Поддержка", "support"),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData(autoRenewButtonLabel(subscription), fmt.Sprintf("autorenew_%d", subscription.ID)),
+			),
+		)
+		msg := tgbotapi.NewMessage(chatID, text)
+		msg.ParseMode = "Markdown"
+		msg.ReplyMarkup = keyboard
+		if _, err := bot.Send(msg); err != nil {
+			log.Printf("🔴 Ошибка отправки подписки %d: %v", subscription.ID, err)
+		}
+	}
+}
+
+// sendSubscriptionKey отправляет владельцу подписки VLESS-ссылку, QR-код и инструкции по подключению.
+func sendSubscriptionKey(bot *tgbotapi.BotAPI, chatID int64, user *db.User, subscriptionID int) {
+	var subscription db.Subscription
+	// Ключ отозванной подписки возвращён в пул и может принадлежать другому пользователю.
+	err := db.DB.Preload("VLESSKey").
+		Where("id = ? AND user_id = ? AND status <> ?", subscriptionID, user.ID, db.SubscriptionRevoked).
+		First(&subscription).Error
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка: подписка не найдена."))
+		return
+	}
+
+	services.DeliverVLESSKey(chatID, subscription.VLESSKey.Key)
+}
+
+// autoRenewStatus возвращает описание состояния автопродления подписки.
+func autoRenewStatus(subscription db.Subscription) string {
+	switch {
+	case !subscription.AutoRenew:
+		return "выключено"
+	case subscription.PaymentMethodID == "":
+		return "включено, карта будет сохранена при следующей оплате"
+	default:
+		return fmt.Sprintf("включено (%s)", subscription.PaymentMethodTitle)
+	}
+}
+
+// autoRenewButtonLabel возвращает подпись кнопки переключения автопродления.
+func autoRenewButtonLabel(subscription db.Subscription) string {
+	if subscription.AutoRenew {
+		return "🔁 Выключить автопродление"
+	}
+	return "🔁 Включить автопродление"
+}
+
+// toggleAutoRenew включает или выключает автопродление подписки пользователя.
+// Если сохранённого способа оплаты ещё нет, предлагает продлить подписку – карта сохранится при оплате.
+func toggleAutoRenew(bot *tgbotapi.BotAPI, chatID int64, user *db.User, subscriptionID int) {
+	subscription, err := findUserSubscription(user, subscriptionID)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка: подписка не найдена."))
+		return
+	}
+
+	if err := services.SetAutoRenew(&subscription, !subscription.AutoRenew); err != nil {
+		log.Printf("🔴 %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Не удалось изменить автопродление. Попробуйте позже."))
+		return
+	}
+
+	if !subscription.AutoRenew {
+		bot.Send(tgbotapi.NewMessage(chatID, "🔁 Автопродление выключено. Мы напомним об окончании подписки заранее."))
+		return
+	}
+	if subscription.PaymentMethodID != "" {
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf(
+			"🔁 Автопродление включено. Оплата будет списана с %s за несколько дней до окончания подписки.",
+			subscription.PaymentMethodTitle,
+		)))
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatID, "🔁 Автопродление включено. Чтобы сохранить карту для автоматических списаний, оплатите продление картой один раз.")
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 Продлить", fmt.Sprintf("renew_%d", subscription.ID)),
+		),
+	)
+	bot.Send(msg)
+}
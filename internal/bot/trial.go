@@ -0,0 +1,49 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"gorm.io/gorm"
+)
+
+// sendTrialOffer предлагает выбрать сервер для пробного периода, если он ещё доступен пользователю.
+func sendTrialOffer(bot *tgbotapi.BotAPI, chatID int64, user *db.User) {
+	days := services.TrialDays()
+	if days == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "Пробный период сейчас недоступен."))
+		return
+	}
+	if user.TrialUsedAt != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "Вы уже воспользовались пробным периодом. Оформить подписку можно через «🚀 Купить подписку»."))
+		return
+	}
+
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("🎁 Пробный период – %d дн. бесплатно, один раз для каждого пользователя.", days)))
+	sendServerSelection(bot, chatID, "trial_")
+}
+
+// activateTrial выдаёт пользователю пробную подписку на выбранный сервер и отправляет ключ.
+func activateTrial(bot *tgbotapi.BotAPI, chatID int64, user *db.User, serverID int) {
+	subscription, key, err := services.ActivateTrial(user, serverID)
+	if errors.Is(err, services.ErrTrialUsed) {
+		bot.Send(tgbotapi.NewMessage(chatID, "Вы уже воспользовались пробным периодом."))
+		return
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		bot.Send(tgbotapi.NewMessage(chatID, "К сожалению, на данном сервере нет доступных ключей 😞"))
+		return
+	} else if err != nil {
+		log.Printf("🔴 Ошибка активации пробного периода пользователя %d: %v", user.ID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка при активации пробного периода. Попробуйте позже."))
+		return
+	}
+
+	text := fmt.Sprintf("✅ Пробный период активирован до %s!", subscription.ExpiresAt.Format("02.01.2006 15:04"))
+	bot.Send(tgbotapi.NewMessage(chatID, text))
+	services.DeliverVLESSKey(chatID, key.Key)
+}
@@ -0,0 +1,38 @@
+package bot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vpn-bot/internal/services"
+)
+
+func TestHandleYooKassaWebhookRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		ipCheck    string
+		body       string
+		want       int
+	}{
+		{"чужой адрес при проверке по умолчанию", "203.0.113.7:443", "", `{}`, http.StatusForbidden},
+		{"не уведомление", "203.0.113.7:443", "false", `{"hello":"world"}`, http.StatusBadRequest},
+		{"слишком большое тело", "203.0.113.7:443", "false", strings.Repeat(" ", services.MaxWebhookBodySize+1), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("YOOKASSA_WEBHOOK_IP_CHECK", tt.ipCheck)
+			r := httptest.NewRequest("POST", "/yookassa-webhook", strings.NewReader(tt.body))
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+
+			handleYooKassaWebhook(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("код ответа %d, ожидался %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package db
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -24,12 +27,188 @@ func InitDB() {
 		log.Fatalf("🔴 Ошибка подключения к БД: %v", err)
 	}
 
-	// Автоматическая миграция моделей: User, Server, VLESSKey, Payment
-	err = dbInstance.AutoMigrate(&User{}, &Server{}, &VLESSKey{}, &Payment{})
+	// Автоматическая миграция моделей
+	err = dbInstance.AutoMigrate(
+		&User{}, &Server{}, &VLESSKey{}, &Payment{}, &Subscription{}, &Plan{},
+		&PromoCode{}, &PromoRedemption{}, &Referral{}, &BalanceTransaction{}, &Refund{},
+		&WebhookEvent{}, &SchemaMigration{},
+	)
 	if err != nil {
 		log.Fatalf("🔴 Ошибка миграции: %v", err)
 	}
 
+	if err := seedPlans(dbInstance); err != nil {
+		log.Fatalf("🔴 Ошибка создания тарифных планов: %v", err)
+	}
+
+	if err := runOnce(dbInstance, "telegram_user_ids", migrateTelegramUserIDs); err != nil {
+		log.Fatalf("🔴 Ошибка переноса Telegram ID на пользователей: %v", err)
+	}
+
+	if err := backfillSubscriptions(dbInstance); err != nil {
+		log.Fatalf("🔴 Ошибка переноса выданных ключей в подписки: %v", err)
+	}
+
 	DB = dbInstance
 	fmt.Println("✅ База данных успешно подключена и проинициализирована!")
 }
+
+// seedPlans создаёт тарифные планы из цен серверов (Price1/3/6/12), если планов в БД ещё нет.
+func seedPlans(dbInstance *gorm.DB) error {
+	var count int64
+	if err := dbInstance.Model(&Plan{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	var servers []Server
+	if err := dbInstance.Find(&servers).Error; err != nil {
+		return err
+	}
+
+	for _, server := range servers {
+		prices := []struct {
+			months int
+			price  float64
+		}{
+			{1, server.Price1}, {3, server.Price3}, {6, server.Price6}, {12, server.Price12},
+		}
+		for i, p := range prices {
+			if p.price <= 0 {
+				continue
+			}
+			plan := Plan{
+				ServerID:  &server.ID,
+				Months:    p.months,
+				Price:     p.price,
+				IsActive:  true,
+				SortOrder: i,
+			}
+			// Подпись скидки считаем относительно помесячной оплаты.
+			if full := server.Price1 * float64(p.months); server.Price1 > 0 && p.price < full {
+				plan.DiscountLabel = fmt.Sprintf("-%.0f%%", (1-p.price/full)*100)
+			}
+			if err := dbInstance.Create(&plan).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// legacySubscriptionDays – срок подписки, который считался от VLESSKey.AssignedAt до появления
+// модели Subscription.
+const legacySubscriptionDays = 30
+
+// backfillSubscriptions оформляет подписки для ключей, выданных до появления модели Subscription,
+// чтобы на них распространялись напоминания, «Мои подписки» и продление. Срок, как и раньше,
+// отсчитывается от AssignedAt. Ключи, у которых уже есть подписка, пропускаются, поэтому
+// повторный запуск ничего не меняет.
+func backfillSubscriptions(dbInstance *gorm.DB) error {
+	var keys []VLESSKey
+	err := dbInstance.
+		Where("is_used = ? AND user_id IS NOT NULL AND assigned_at IS NOT NULL", true).
+		Where("NOT EXISTS (SELECT 1 FROM subscriptions WHERE subscriptions.vless_key_id = vless_keys.id)").
+		Find(&keys).Error
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		expiresAt := key.AssignedAt.AddDate(0, 0, legacySubscriptionDays)
+		status := SubscriptionActive
+		if expiresAt.Before(now) {
+			status = SubscriptionExpired
+		}
+		subscription := Subscription{
+			UserID:     *key.UserID,
+			ServerID:   key.ServerID,
+			VLESSKeyID: key.ID,
+			Months:     1,
+			StartsAt:   *key.AssignedAt,
+			ExpiresAt:  expiresAt,
+			Status:     status,
+		}
+		if err := dbInstance.Create(&subscription).Error; err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		log.Printf("✅ Оформлено подписок для ранее выданных ключей: %d", len(keys))
+	}
+	return nil
+}
+
+// runOnce выполняет однократную миграцию данных name в транзакции и отмечает её выполненной.
+func runOnce(dbInstance *gorm.DB, name string, migrate func(tx *gorm.DB) error) error {
+	return dbInstance.Transaction(func(tx *gorm.DB) error {
+		var applied int64
+		if err := tx.Model(&SchemaMigration{}).Where("name = ?", name).Count(&applied).Error; err != nil {
+			return err
+		}
+		if applied > 0 {
+			return nil
+		}
+		if err := migrate(tx); err != nil {
+			return err
+		}
+		return tx.Create(&SchemaMigration{Name: name, AppliedAt: time.Now()}).Error
+	})
+}
+
+// migrateTelegramUserIDs переводит платежи, ключи и подписки, в user_id которых записан
+// Telegram ID, на User.ID: создаёт недостающих пользователей и переписывает user_id.
+// Такими считаются записи, появившиеся до первого визита пользователя, сохранённого ботом
+// (users.first_seen_at), а если таких пользователей нет – все записи.
+func migrateTelegramUserIDs(tx *gorm.DB) error {
+	var firstSeen sql.NullTime
+	if err := tx.Raw("SELECT MIN(first_seen_at) FROM users WHERE first_seen_at > ?", time.Time{}).
+		Row().Scan(&firstSeen); err != nil {
+		return err
+	}
+	cutoff := time.Now()
+	if firstSeen.Valid {
+		cutoff = firstSeen.Time
+	}
+	args := map[string]interface{}{"cutoff": cutoff}
+
+	// Для ключей граница – время выдачи: сами ключи загружаются в БД заранее.
+	legacy := []struct {
+		table     string
+		condition string
+	}{
+		{"payments", "payments.created_at < @cutoff"},
+		{"vless_keys", "vless_keys.user_id IS NOT NULL AND vless_keys.assigned_at < @cutoff"},
+		{"subscriptions", "subscriptions.created_at < @cutoff"},
+	}
+
+	var telegramIDs []string
+	for _, l := range legacy {
+		telegramIDs = append(telegramIDs, fmt.Sprintf("SELECT user_id FROM %s WHERE %s", l.table, l.condition))
+	}
+	result := tx.Exec(`
+		INSERT INTO users (telegram_id, username, first_name, language_code, email, phone, first_seen_at, last_seen_at, created_at, updated_at)
+		SELECT legacy.user_id, '', '', '', '', '', NOW(), NOW(), NOW(), NOW()
+		FROM (`+strings.Join(telegramIDs, " UNION ")+`) AS legacy
+		ON CONFLICT (telegram_id) DO NOTHING`, args)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("✅ Создано пользователей по Telegram ID из старых записей: %d", result.RowsAffected)
+	}
+
+	for _, l := range legacy {
+		err := tx.Exec(fmt.Sprintf(
+			"UPDATE %[1]s SET user_id = users.id FROM users WHERE users.telegram_id = %[1]s.user_id AND %[2]s",
+			l.table, l.condition,
+		), args).Error
+		if err != nil {
+			return fmt.Errorf("ошибка переноса %s: %v", l.table, err)
+		}
+	}
+	return nil
+}
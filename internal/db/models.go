@@ -6,14 +6,26 @@ import (
 
 // User представляет пользователя бота.
 type User struct {
-	ID              int       `gorm:"primaryKey"`
-	TelegramID      int64     `gorm:"uniqueIndex"` // Telegram ID пользователя
-	CurrentDiscount int       `gorm:"default:0"`   // Текущая скидка в процентах
-	CreatedAt       time.Time // Дата создания записи
-	UpdatedAt       time.Time // Дата обновления записи
+	ID              int        `gorm:"primaryKey"`
+	TelegramID      int64      `gorm:"uniqueIndex"` // Telegram ID пользователя
+	Username        string     // Имя пользователя в Telegram (@username)
+	FirstName       string     // Имя пользователя в Telegram
+	LanguageCode    string     // Язык интерфейса Telegram пользователя
+	CurrentDiscount int        `gorm:"default:0"` // Текущая скидка в процентах
+	DiscountUntil   *time.Time // Срок действия персональной скидки; nil – бессрочно
+	BonusDays       int        `gorm:"default:0"` // Накопленные бонусные дни, которые добавятся к следующей подписке
+	TrialUsedAt     *time.Time // Время активации пробного периода; nil – пробный период не использован
+	Balance         float64    `gorm:"default:0"` // Текущий баланс; изменяется только вместе с записями BalanceTransaction
+	Email           string     // Email для отправки чеков 54-ФЗ
+	Phone           string     // Телефон для отправки чеков 54-ФЗ в формате 7XXXXXXXXXX
+	FirstSeenAt     time.Time  // Время первого обращения к боту
+	LastSeenAt      time.Time  // Время последнего обращения к боту
+	CreatedAt       time.Time  // Дата создания записи
+	UpdatedAt       time.Time  // Дата обновления записи
 }
 
 // Server представляет сервер (локацию) для VPN-подписок.
+// Цены Price1/3/6/12 используются только для начального заполнения тарифных планов (Plan).
 type Server struct {
 	ID        int     `gorm:"primaryKey"`
 	Name      string  `gorm:"unique;not null"` // Название сервера
@@ -34,19 +46,201 @@ type VLESSKey struct {
 	Key           string     `gorm:"unique;not null"` // VLESS-ключ в формате vless://...
 	IsUsed        bool       `gorm:"default:false"`   // Флаг использования ключа
 	ReservedUntil *time.Time // Время, до которого ключ зарезервирован
-	UserID        *int       `gorm:"index"` // ID пользователя, если ключ закреплен
+	UserID        *int       `gorm:"index"` // ID пользователя (User.ID), за которым закреплен или зарезервирован ключ
 	AssignedAt    *time.Time // Время закрепления ключа за пользователем
+	RetiredAt     *time.Time `gorm:"index"` // Время отзыва ключа у пользователя: ключ ещё действует на сервере и не выдаётся, пока его не перевыпустят
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 }
 
+// Назначения платежа.
+const (
+	PaymentKindSubscription = "subscription" // Покупка или продление подписки
+	PaymentKindTopUp        = "topup"        // Пополнение баланса
+)
+
+// Статусы платежа. Допустимые переходы: pending → waiting_for_capture → succeeded/canceled,
+// pending → succeeded/canceled и succeeded → refunded.
+const (
+	PaymentPending           = "pending"             // Платеж создан и ожидает оплаты
+	PaymentWaitingForCapture = "waiting_for_capture" // Оплачен, ожидает подтверждения списания
+	PaymentSucceeded         = "succeeded"           // Оплата прошла
+	PaymentCanceled          = "canceled"            // Платеж отменён или не оплачен
+	PaymentRefunded          = "refunded"            // Оплата полностью возвращена
+)
+
 // Payment представляет платеж, произведенный пользователем через Юкассу.
+// Платеж может быть частично или полностью оплачен с баланса (BalanceAmount).
 type Payment struct {
+	ID                int     `gorm:"primaryKey"`
+	UserID            int     `gorm:"index;not null"`         // ID пользователя (User.ID), совершившего платеж
+	YooKassaID        string  `gorm:"uniqueIndex;not null"`   // Идентификатор платежа в Юкассе
+	Kind              string  `gorm:"default:'subscription'"` // Назначение платежа (subscription, topup)
+	ServerID          int     `gorm:"index"`                  // ID сервера, на который оформляется подписка
+	SubscriptionID    *int    `gorm:"index"`                  // ID продлеваемой подписки (для платежей продления)
+	ReservedKeyID     *int    `gorm:"index"`                  // ID VLESS-ключа, зарезервированного под этот платеж
+	PlanID            *int    `gorm:"index"`                  // ID оплаченного тарифного плана
+	Months            int     // Срок подписки в месяцах
+	Amount            float64 // Сумма платежа картой через Юкассу
+	BalanceAmount     float64 // Часть суммы, списанная с баланса пользователя
+	SavePaymentMethod bool    // Запрошено сохранение способа оплаты для автопродления
+	IsAutoRenew       bool    // Автоматическое списание с сохранённого способа оплаты
+	RefundedAmount    float64 // Сумма, возвращённая (или возвращаемая) на карту через Юкассу
+	ReceiptStatus     string  `gorm:"index"`             // Статус регистрации чека 54-ФЗ в Юкассе (pending, succeeded, canceled); пусто – чек не передавался
+	Status            string  `gorm:"default:'pending'"` // Статус платежа (pending, waiting_for_capture, succeeded, canceled, refunded)
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// Plan представляет тарифный план. План с пустым ServerID действует для всех серверов,
+// у которых нет собственных планов.
+type Plan struct {
+	ID            int     `gorm:"primaryKey"`
+	ServerID      *int    `gorm:"index"`    // ID сервера; nil – глобальный план
+	Months        int     `gorm:"not null"` // Срок подписки в месяцах
+	Price         float64 `gorm:"not null"` // Стоимость плана
+	DiscountLabel string  // Подпись скидки на кнопке (например, "-10%")
+	IsActive      bool    `gorm:"default:true"` // Доступен ли план для покупки
+	SortOrder     int     `gorm:"default:0"`    // Порядок вывода в клавиатуре тарифов
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Статусы подписки.
+const (
+	SubscriptionActive  = "active"  // Подписка действует
+	SubscriptionExpired = "expired" // Срок подписки истёк
+	SubscriptionRevoked = "revoked" // Подписка отозвана (например, после возврата), ключ возвращён в пул
+)
+
+// Subscription представляет оплаченную подписку пользователя на сервер.
+type Subscription struct {
+	ID                 int        `gorm:"primaryKey"`
+	UserID             int        `gorm:"index;not null"` // ID пользователя-владельца подписки (User.ID)
+	ServerID           int        `gorm:"index;not null"` // ID сервера
+	VLESSKeyID         int        `gorm:"index;not null"` // ID выданного VLESS-ключа
+	PaymentID          int        `gorm:"index"`          // ID платежа, которым оформлена подписка
+	Months             int        // Оплаченный срок в месяцах (0 – пробный период)
+	IsTrial            bool       `gorm:"default:false"` // Пробная подписка, выданная без оплаты
+	StartsAt           time.Time  // Дата начала подписки
+	ExpiresAt          time.Time  `gorm:"index"`                  // Дата окончания подписки
+	Status             string     `gorm:"index;default:'active'"` // Статус подписки (active, expired, revoked)
+	AutoRenew          bool       `gorm:"default:false"`          // Включено ли автопродление
+	PaymentMethodID    string     // Сохранённый в Юкассе способ оплаты для автопродления
+	PaymentMethodTitle string     // Название сохранённого способа оплаты (например, "Bank card *4444")
+	AutoRenewFailures  int        `gorm:"default:0"` // Неудачных попыток автопродления подряд
+	AutoRenewAttemptAt *time.Time // Время последней попытки автопродления
+	Server             Server     // Сервер подписки
+	VLESSKey           VLESSKey   // VLESS-ключ подписки
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+// PromoCode представляет промокод рекламной кампании. Скидка задаётся либо в процентах (Percent),
+// либо фиксированной суммой (Amount).
+type PromoCode struct {
+	ID             int        `gorm:"primaryKey"`
+	Code           string     `gorm:"uniqueIndex;not null"` // Текст промокода (в верхнем регистре)
+	Percent        int        // Скидка в процентах
+	Amount         float64    // Фиксированная скидка в рублях
+	MaxUses        int        // Максимальное число использований; 0 – без ограничений
+	PerUserLimit   int        `gorm:"default:1"` // Сколько раз один пользователь может применить промокод; 0 – без ограничений
+	ValidFrom      *time.Time // Начало действия промокода
+	ValidTo        *time.Time // Окончание действия промокода
+	AllowedServers string     // ID серверов через запятую; пусто – все серверы
+	AllowedPlans   string     // ID тарифных планов через запятую; пусто – все планы
+	IsActive       bool       `gorm:"default:true"` // Включен ли промокод
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// PromoRedemption фиксирует применение промокода в конкретном платеже.
+type PromoRedemption struct {
+	ID          int     `gorm:"primaryKey"`
+	PromoCodeID int     `gorm:"index;not null"`       // ID промокода
+	UserID      int     `gorm:"index;not null"`       // ID пользователя (User.ID)
+	PaymentID   int     `gorm:"uniqueIndex;not null"` // ID платежа, в котором применён промокод
+	Discount    float64 // Сумма скидки по промокоду
+	CreatedAt   time.Time
+}
+
+// Referral связывает пригласившего пользователя с приглашённым по реферальной ссылке.
+type Referral struct {
+	ID                  int        `gorm:"primaryKey"`
+	InviterID           int        `gorm:"index;not null"`       // ID пригласившего пользователя (User.ID)
+	InviteeID           int        `gorm:"uniqueIndex;not null"` // ID приглашённого пользователя (User.ID)
+	RewardPaymentID     *int       // ID первого успешного платежа приглашённого, за который начислен бонус
+	BonusDays           int        // Начисленные пригласившему бонусные дни
+	BonusAmount         float64    // Начисленная пригласившему сумма на баланс
+	RewardedAt          *time.Time // Время начисления бонуса
+	BonusSubscriptionID *int       // ID подписки пригласившего, продлённой бонусными днями; nil – дни зачислены в User.BonusDays
+	ReversedAt          *time.Time // Время отмены бонуса после полного возврата платежа приглашённого
+	CreatedAt           time.Time
+}
+
+// BalanceTransaction – запись журнала движения средств по двойной записи. Каждое движение
+// (TransferID) состоит из двух записей с противоположными суммами: по счёту пользователя
+// ("user:<id>") и по системному счёту-источнику ("system:<назначение>").
+type BalanceTransaction struct {
 	ID         int     `gorm:"primaryKey"`
-	UserID     int     `gorm:"index;not null"`       // ID пользователя, совершившего платеж
-	YooKassaID string  `gorm:"uniqueIndex;not null"` // Идентификатор платежа в Юкассе
-	Amount     float64 // Сумма платежа
-	Status     string  `gorm:"default:'pending'"` // Статус платежа (pending, succeeded, failed, и т.д.)
+	TransferID string  `gorm:"index;not null"` // Идентификатор движения, объединяющий пару записей
+	Account    string  `gorm:"index;not null"` // Счёт: user:<id> или system:<назначение>
+	UserID     *int    `gorm:"index"`          // ID пользователя для записей по счёту пользователя
+	Amount     float64 `gorm:"not null"`       // Сумма: положительная – зачисление, отрицательная – списание
+	Kind       string  `gorm:"index;not null"` // Тип движения (topup, referral, refund, admin, purchase)
+	PaymentID  *int    `gorm:"index"`          // ID связанного платежа
+	Comment    string  // Комментарий (например, причина корректировки)
 	CreatedAt  time.Time
-	UpdatedAt  time.Time
+}
+
+// Статусы возврата.
+const (
+	RefundPending   = "pending"   // Возврат создан и ожидает обработки в Юкассе
+	RefundSucceeded = "succeeded" // Возврат проведён
+	RefundCanceled  = "canceled"  // Возврат отклонён Юкассой
+)
+
+// Refund представляет полный или частичный возврат средств по платежу.
+type Refund struct {
+	ID            int     `gorm:"primaryKey"`
+	PaymentID     int     `gorm:"index;not null"` // ID платежа (Payment.ID), по которому оформлен возврат
+	YooKassaID    string  `gorm:"index"`          // Идентификатор возврата в Юкассе; пусто, если возвращается только баланс
+	Amount        float64 // Сумма возврата на карту через Юкассу
+	BalanceAmount float64 // Сумма, возвращаемая на баланс пользователя (часть платежа, оплаченная с баланса)
+	Reason        string  // Причина возврата
+	Status        string  `gorm:"index;default:'pending'"` // Статус возврата (pending, succeeded, canceled)
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// Статусы обработки уведомления Юкассы.
+const (
+	WebhookEventPending    = "pending"    // Ожидает обработки или повторной попытки
+	WebhookEventProcessing = "processing" // Обрабатывается; NextAttemptAt – окончание аренды обработчика
+	WebhookEventProcessed  = "processed"  // Обработано
+	WebhookEventFailed     = "failed"     // Обработать не удалось; можно повторить командой администратора
+)
+
+// WebhookEvent хранит входящее уведомление Юкассы до и после его обработки.
+type WebhookEvent struct {
+	ID            int        `gorm:"primaryKey"`
+	Event         string     `gorm:"index"`     // Тип события, например payment.succeeded
+	ObjectID      string     `gorm:"index"`     // ID платежа или возврата из уведомления
+	Body          string     `gorm:"type:text"` // Исходное тело уведомления
+	Headers       string     `gorm:"type:text"` // Заголовки запроса в формате JSON
+	RemoteAddr    string     // Адрес отправителя
+	Status        string     `gorm:"index;default:'pending'"` // Статус обработки (pending, processing, processed, failed)
+	Attempts      int        `gorm:"default:0"`               // Число попыток обработки
+	NextAttemptAt time.Time  `gorm:"index"`                   // Время следующей попытки обработки
+	Error         string     // Ошибка последней попытки
+	ReceivedAt    time.Time  `gorm:"index"` // Время получения уведомления
+	ProcessedAt   *time.Time // Время успешной обработки
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+}
+
+// SchemaMigration отмечает однократную миграцию данных, которая уже выполнена.
+type SchemaMigration struct {
+	Name      string    `gorm:"primaryKey"` // Имя миграции
+	AppliedAt time.Time // Время выполнения
 }
@@ -3,44 +3,33 @@ package handlers
 import (
 	"fmt"
 	"log"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"vpn-bot/internal/db"
+	"vpn-bot/internal/services"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-// getAdminID получает ID администратора из переменной окружения.
-func getAdminID() int64 {
-	adminIDStr := os.Getenv("ADMIN_TELEGRAM_ID") // 🔴 ! Убедитесь, что ADMIN_TELEGRAM_ID заполнена корректно!
-	adminID, err := strconv.ParseInt(adminIDStr, 10, 64)
-	if err != nil {
-		log.Fatalf("🔴 Ошибка преобразования ADMIN_TELEGRAM_ID: %v", err)
-	}
-	return adminID
-}
-
 // ListServersHandler обрабатывает команду /listservers для администратора.
+// Права администратора проверяются middleware роутера команд.
 func ListServersHandler(bot *tgbotapi.BotAPI, chatID int64) {
-	if chatID != getAdminID() {
-		bot.Send(tgbotapi.NewMessage(chatID, "⛔ Доступ запрещён"))
-		return
-	}
-
 	// Получаем список серверов с подсчётом свободных ключей
 	var result []struct {
-		Name      string
-		IP        string
-		FreeKeys  int
-		TotalKeys int
-		IsActive  bool
+		Name        string
+		IP          string
+		FreeKeys    int
+		RetiredKeys int
+		TotalKeys   int
+		IsActive    bool
 	}
 
 	err := db.DB.Raw(`
 		SELECT s.name, s.ip,
 			COUNT(CASE WHEN k.is_used = false THEN 1 END) AS free_keys,
+			COUNT(k.retired_at) AS retired_keys,
 			COUNT(k.id) AS total_keys,
 			s.is_active
 		FROM servers s
@@ -61,9 +50,13 @@ func ListServersHandler(bot *tgbotapi.BotAPI, chatID int64) {
 			status = "🔴 Неактивен"
 		}
 		message += fmt.Sprintf(
-			"\n🌍 *%s* (%s)\n🔑 Свободных ключей: %d / %d\n%s\n",
-			server.Name, server.IP, server.FreeKeys, server.TotalKeys, status,
+			"\n🌍 *%s* (%s)\n🔑 Свободных ключей: %d / %d\n",
+			server.Name, server.IP, server.FreeKeys, server.TotalKeys,
 		)
+		if server.RetiredKeys > 0 {
+			message += fmt.Sprintf("♻️ Ждут перевыпуска: %d (/reissuekey)\n", server.RetiredKeys)
+		}
+		message += status + "\n"
 	}
 
 	msg := tgbotapi.NewMessage(chatID, message)
@@ -72,12 +65,8 @@ func ListServersHandler(bot *tgbotapi.BotAPI, chatID int64) {
 }
 
 // BroadcastHandler обрабатывает команду /broadcast <сообщение> для рассылки всем пользователям.
+// Права администратора проверяются middleware роутера команд.
 func BroadcastHandler(bot *tgbotapi.BotAPI, chatID int64, broadcastText string) {
-	if chatID != getAdminID() {
-		bot.Send(tgbotapi.NewMessage(chatID, "⛔ Доступ запрещён"))
-		return
-	}
-
 	// Получаем список всех пользователей
 	var users []db.User
 	err := db.DB.Select("telegram_id").Find(&users).Error
@@ -102,22 +91,316 @@ func BroadcastHandler(bot *tgbotapi.BotAPI, chatID int64, broadcastText string)
 	bot.Send(tgbotapi.NewMessage(chatID, response))
 }
 
-// HandleAdminCommand определяет, какую админ-команду выполнить, исходя из входящего сообщения.
-func HandleAdminCommand(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
-	chatID := update.Message.Chat.ID
-	text := update.Message.Text
-
-	if text == "/listservers" {
-		ListServersHandler(bot, chatID)
-	} else if strings.HasPrefix(text, "/broadcast") {
-		// Формат команды: /broadcast <сообщение>
-		parts := strings.SplitN(text, " ", 2)
-		if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
-			bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Использование: /broadcast <сообщение>"))
+// DiscountHandler обрабатывает команду /discount <telegramID> <процент> [дней] – выдачу персональной скидки.
+// Без количества дней скидка действует бессрочно, процент 0 отменяет скидку.
+func DiscountHandler(bot *tgbotapi.BotAPI, chatID int64, args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 || len(fields) > 3 {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Использование: /discount <telegramID> <процент> [дней]"))
+		return
+	}
+
+	telegramID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Некорректный Telegram ID"))
+		return
+	}
+	percent, err := strconv.Atoi(fields[1])
+	if err != nil || percent < 0 || percent > 100 {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Процент скидки должен быть числом от 0 до 100"))
+		return
+	}
+	var until *time.Time
+	if len(fields) == 3 {
+		days, err := strconv.Atoi(fields[2])
+		if err != nil || days <= 0 {
+			bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Срок скидки должен быть положительным числом дней"))
+			return
+		}
+		t := time.Now().AddDate(0, 0, days)
+		until = &t
+	}
+
+	setUserDiscount(bot, chatID, telegramID, percent, until)
+}
+
+// RevokeDiscountHandler обрабатывает команду /revokediscount <telegramID> – отмену персональной скидки.
+func RevokeDiscountHandler(bot *tgbotapi.BotAPI, chatID int64, args string) {
+	telegramID, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Использование: /revokediscount <telegramID>"))
+		return
+	}
+	setUserDiscount(bot, chatID, telegramID, 0, nil)
+}
+
+// setUserDiscount сохраняет персональную скидку пользователя и уведомляет его об изменении.
+func setUserDiscount(bot *tgbotapi.BotAPI, chatID int64, telegramID int64, percent int, until *time.Time) {
+	result := db.DB.Model(&db.User{}).
+		Where("telegram_id = ?", telegramID).
+		Updates(map[string]interface{}{
+			"current_discount": percent,
+			"discount_until":   until,
+		})
+	if result.Error != nil {
+		log.Printf("🔴 Ошибка изменения скидки пользователя %d: %v", telegramID, result.Error)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка изменения скидки"))
+		return
+	}
+	if result.RowsAffected == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Пользователь не найден"))
+		return
+	}
+
+	if percent == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Скидка пользователя %d отменена", telegramID)))
+		return
+	}
+
+	userText := fmt.Sprintf("🎁 Вам назначена персональная скидка %d%% на подписку!", percent)
+	adminText := fmt.Sprintf("✅ Пользователю %d назначена скидка %d%%", telegramID, percent)
+	if until != nil {
+		userText += fmt.Sprintf(" Она действует до %s.", until.Format("02.01.2006"))
+		adminText += fmt.Sprintf(" до %s", until.Format("02.01.2006"))
+	}
+	bot.Send(tgbotapi.NewMessage(telegramID, userText))
+	bot.Send(tgbotapi.NewMessage(chatID, adminText))
+}
+
+// AddPromoHandler обрабатывает команду /addpromo <КОД> <10%|300> [макс. использований] [дней] – создание промокода.
+// Скидка с символом % задаётся в процентах, без него – фиксированной суммой в рублях.
+func AddPromoHandler(bot *tgbotapi.BotAPI, chatID int64, args string) {
+	usage := "⚠️ Использование: /addpromo <КОД> <10%|300> [макс. использований] [дней]"
+	fields := strings.Fields(args)
+	if len(fields) < 2 || len(fields) > 4 {
+		bot.Send(tgbotapi.NewMessage(chatID, usage))
+		return
+	}
+
+	promo := db.PromoCode{
+		Code:         strings.ToUpper(fields[0]),
+		PerUserLimit: 1,
+		IsActive:     true,
+	}
+	if strings.HasSuffix(fields[1], "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(fields[1], "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Процент скидки должен быть числом от 1 до 100"))
 			return
 		}
-		BroadcastHandler(bot, chatID, parts[1])
+		promo.Percent = percent
 	} else {
-		bot.Send(tgbotapi.NewMessage(chatID, "Неизвестная админ-команда"))
+		amount, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || amount <= 0 {
+			bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Сумма скидки должна быть положительным числом"))
+			return
+		}
+		promo.Amount = amount
+	}
+	if len(fields) >= 3 {
+		maxUses, err := strconv.Atoi(fields[2])
+		if err != nil || maxUses < 0 {
+			bot.Send(tgbotapi.NewMessage(chatID, usage))
+			return
+		}
+		promo.MaxUses = maxUses
+	}
+	if len(fields) == 4 {
+		days, err := strconv.Atoi(fields[3])
+		if err != nil || days <= 0 {
+			bot.Send(tgbotapi.NewMessage(chatID, usage))
+			return
+		}
+		validTo := time.Now().AddDate(0, 0, days)
+		promo.ValidTo = &validTo
+	}
+
+	if err := db.DB.Create(&promo).Error; err != nil {
+		log.Printf("🔴 Ошибка создания промокода %s: %v", promo.Code, err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка создания промокода (возможно, такой код уже существует)"))
+		return
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Промокод %s создан", promo.Code)))
+}
+
+// AdjustBalanceHandler обрабатывает команду /addbalance <telegramID> <сумма> [комментарий] –
+// корректировку баланса пользователя. Отрицательная сумма списывает средства.
+func AdjustBalanceHandler(bot *tgbotapi.BotAPI, chatID int64, args string) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 3)
+	if len(fields) < 2 {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Использование: /addbalance <telegramID> <сумма> [комментарий]"))
+		return
+	}
+
+	telegramID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Некорректный Telegram ID"))
+		return
+	}
+	amount, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || amount == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Сумма должна быть ненулевым числом"))
+		return
+	}
+	comment := "Корректировка администратором"
+	if len(fields) == 3 {
+		comment = fields[2]
+	}
+
+	var user db.User
+	if err := db.DB.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Пользователь не найден"))
+		return
+	}
+	if err := services.AdjustBalance(user.ID, amount, services.BalanceAdmin, nil, comment); err != nil {
+		log.Printf("🔴 Ошибка корректировки баланса пользователя %d: %v", telegramID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Ошибка корректировки баланса: %v", err)))
+		return
+	}
+
+	bot.Send(tgbotapi.NewMessage(telegramID, fmt.Sprintf("💰 Ваш баланс изменён на %+.2f₽: %s", amount, comment)))
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Баланс пользователя %d изменён на %+.2f₽", telegramID, amount)))
+}
+
+// RefundHandler обрабатывает команду /refund: полный или частичный возврат по платежу.
+// Формат: /refund <ID платежа в Юкассе или в БД> [сумма] [причина]; без суммы – полный возврат.
+func RefundHandler(bot *tgbotapi.BotAPI, chatID int64, args string) {
+	fields := strings.SplitN(strings.TrimSpace(args), " ", 3)
+	if fields[0] == "" {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Использование: /refund <ID платежа> [сумма] [причина]"))
+		return
+	}
+
+	var payment db.Payment
+	query := db.DB.Where("yoo_kassa_id = ?", fields[0])
+	if id, err := strconv.Atoi(fields[0]); err == nil {
+		query = db.DB.Where("id = ?", id)
+	}
+	if err := query.First(&payment).Error; err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Платеж не найден"))
+		return
+	}
+
+	// Второй аргумент – сумма, если это число, иначе начало причины возврата.
+	var amount float64
+	reason := "Возврат по запросу администратора"
+	rest := fields[1:]
+	if len(rest) > 0 {
+		if value, err := strconv.ParseFloat(rest[0], 64); err == nil {
+			if value <= 0 {
+				bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Сумма возврата должна быть положительной"))
+				return
+			}
+			amount = value
+			rest = rest[1:]
+		}
+	}
+	if len(rest) > 0 {
+		reason = strings.Join(rest, " ")
+	}
+
+	refund, err := services.RefundPayment(&payment, amount, reason)
+	if err != nil {
+		log.Printf("🔴 Ошибка возврата по платежу %s: %v", payment.YooKassaID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Ошибка возврата: %v", err)))
+		return
+	}
+
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf(
+		"✅ Возврат по платежу %s создан: %.2f₽ на карту, %.2f₽ на баланс. Статус: %s",
+		payment.YooKassaID, refund.Amount, refund.BalanceAmount, refund.Status,
+	)))
+}
+
+// WebhookEventsHandler обрабатывает команду /webhooks: последние необработанные уведомления Юкассы.
+func WebhookEventsHandler(bot *tgbotapi.BotAPI, chatID int64) {
+	events, err := services.RecentWebhookEvents(10)
+	if err != nil {
+		log.Printf("🔴 Ошибка запроса уведомлений: %v", err)
+		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка получения списка уведомлений"))
+		return
+	}
+	if len(events) == 0 {
+		bot.Send(tgbotapi.NewMessage(chatID, "✅ Все уведомления Юкассы обработаны"))
+		return
+	}
+
+	message := "📨 Необработанные уведомления Юкассы:\n"
+	for _, event := range events {
+		message += fmt.Sprintf(
+			"\n#%d %s %s\nПолучено: %s, статус: %s, попыток: %d\n",
+			event.ID, event.Event, event.ObjectID,
+			event.ReceivedAt.Format("02.01.2006 15:04"), event.Status, event.Attempts,
+		)
+		if event.Error != "" {
+			message += fmt.Sprintf("Ошибка: %s\n", event.Error)
+		}
+	}
+	message += "\nПовторить обработку: /replaywebhook <ID>"
+	bot.Send(tgbotapi.NewMessage(chatID, message))
+}
+
+// ReplayWebhookHandler обрабатывает команду /replaywebhook <ID>: повторная обработка уведомления Юкассы.
+func ReplayWebhookHandler(bot *tgbotapi.BotAPI, chatID int64, args string) {
+	eventID, err := strconv.Atoi(strings.TrimSpace(args))
+	if err != nil {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Использование: /replaywebhook <ID уведомления>"))
+		return
+	}
+
+	event, err := services.ReplayWebhookEvent(eventID)
+	if err != nil {
+		log.Printf("🔴 Ошибка повтора уведомления #%d: %v", eventID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Ошибка повтора: %v", err)))
+		return
+	}
+
+	switch event.Status {
+	case db.WebhookEventProcessed:
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Уведомление #%d обработано", event.ID)))
+	case db.WebhookEventPending:
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("⚠️ Уведомление #%d не обработано, будет повторено: %s", event.ID, event.Error)))
+	case db.WebhookEventProcessing:
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("⏳ Уведомление #%d обрабатывается, проверьте результат позже командой /webhooks", event.ID)))
+	default:
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("🔴 Уведомление #%d не обработано: %s", event.ID, event.Error)))
+	}
+}
+
+// ReissueKeyHandler обрабатывает команду /reissuekey: без аргументов выводит ключи, отозванные
+// у пользователей и ожидающие перевыпуска, а с аргументами <ID> <vless://...> возвращает ключ
+// в пул с новой ссылкой. Прежнюю ссылку нужно заранее отозвать в панели сервера.
+func ReissueKeyHandler(bot *tgbotapi.BotAPI, chatID int64, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		keys, err := services.RetiredKeys()
+		if err != nil {
+			log.Printf("🔴 %v", err)
+			bot.Send(tgbotapi.NewMessage(chatID, "Ошибка получения списка ключей"))
+			return
+		}
+		if len(keys) == 0 {
+			bot.Send(tgbotapi.NewMessage(chatID, "✅ Нет ключей, ожидающих перевыпуска"))
+			return
+		}
+		message := "♻️ Ключи, ожидающие перевыпуска (отозвать в панели сервера и выпустить новые):\n"
+		for _, key := range keys {
+			message += fmt.Sprintf("\n#%d, сервер %d, отозван %s\n%s\n", key.ID, key.ServerID, key.RetiredAt.Format("02.01.2006 15:04"), key.Key)
+		}
+		message += "\nВернуть в пул: /reissuekey <ID> <новая ссылка vless://...>"
+		bot.Send(tgbotapi.NewMessage(chatID, message))
+		return
+	}
+
+	keyID, err := strconv.Atoi(fields[0])
+	if err != nil || len(fields) != 2 {
+		bot.Send(tgbotapi.NewMessage(chatID, "⚠️ Использование: /reissuekey [<ID ключа> <новая ссылка vless://...>]"))
+		return
+	}
+	if err := services.ReissueKey(keyID, fields[1]); err != nil {
+		log.Printf("🔴 Ошибка перевыпуска ключа %d: %v", keyID, err)
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Ошибка перевыпуска: %v", err)))
+		return
 	}
+	bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ Ключ #%d перевыпущен и возвращён в пул", keyID)))
 }
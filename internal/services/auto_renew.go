@@ -0,0 +1,304 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// defaultAutoRenewDaysBefore – за сколько дней до окончания подписки начинаются попытки
+// автопродления, если AUTO_RENEW_DAYS_BEFORE не задан.
+const defaultAutoRenewDaysBefore = 3
+
+// maxAutoRenewFailures – после стольких неудачных попыток подряд автопродление отключается.
+const maxAutoRenewFailures = 3
+
+// autoRenewRetryInterval – минимальный интервал между попытками автопродления одной подписки.
+const autoRenewRetryInterval = 20 * time.Hour
+
+// autoRenewPaymentPrefix – префикс временного идентификатора платежа автопродления, который
+// записан в БД, но ещё не создан в Юкассе.
+const autoRenewPaymentPrefix = "autorenew-"
+
+// autoRenewResubmitWindow – в течение этого времени после записи платёж автопродления, не дошедший
+// до Юкассы, отправляется повторно: столько Юкасса хранит ключ идемпотентности. Более старые
+// платежи отменяются – их нужно сверить с личным кабинетом.
+const autoRenewResubmitWindow = 24 * time.Hour
+
+// autoRenewDaysBefore возвращает значение AUTO_RENEW_DAYS_BEFORE.
+func autoRenewDaysBefore() int {
+	value := os.Getenv("AUTO_RENEW_DAYS_BEFORE")
+	if value == "" {
+		return defaultAutoRenewDaysBefore
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 1 {
+		log.Printf("🔴 Некорректное значение AUTO_RENEW_DAYS_BEFORE: %q", value)
+		return defaultAutoRenewDaysBefore
+	}
+	return days
+}
+
+// SetAutoRenew включает или выключает автопродление подписки.
+func SetAutoRenew(subscription *db.Subscription, enabled bool) error {
+	updates := map[string]interface{}{
+		"auto_renew":          enabled,
+		"auto_renew_failures": 0,
+	}
+	if err := db.DB.Model(subscription).Updates(updates).Error; err != nil {
+		return fmt.Errorf("ошибка изменения автопродления подписки %d: %v", subscription.ID, err)
+	}
+	subscription.AutoRenew = enabled
+	subscription.AutoRenewFailures = 0
+	return nil
+}
+
+// UpdateAutoRenewAfterPayment после успешной оплаты подписки (покупки или продления) сбрасывает
+// счётчик неудачных попыток автопродления. Если при оплате было запрошено сохранение способа
+// оплаты, он сохраняется для следующих автоматических списаний и автопродление включается.
+func UpdateAutoRenewAfterPayment(payment db.Payment, subscription *db.Subscription) {
+	updates := map[string]interface{}{"auto_renew_failures": 0}
+	var saved *YooKassaPaymentMethod
+	if payment.SavePaymentMethod && payment.Amount > 0 {
+		paymentResp, err := GetYooKassaPayment(payment.YooKassaID)
+		if err != nil {
+			log.Printf("🔴 Ошибка получения способа оплаты платежа %s: %v", payment.YooKassaID, err)
+		} else if paymentResp.PaymentMethod.Saved {
+			saved = &paymentResp.PaymentMethod
+			updates["auto_renew"] = true
+			updates["payment_method_id"] = saved.ID
+			updates["payment_method_title"] = saved.Title
+		} else {
+			NotifyUser(payment.UserID, "⚠️ Юкасса не сохранила способ оплаты – автопродление не включено. Подписку можно продлить вручную в разделе «Мои подписки».")
+		}
+	}
+
+	if err := db.DB.Model(subscription).Updates(updates).Error; err != nil {
+		log.Printf("🔴 Ошибка обновления автопродления подписки %d: %v", subscription.ID, err)
+		return
+	}
+	subscription.AutoRenewFailures = 0
+	if saved != nil {
+		subscription.AutoRenew = true
+		subscription.PaymentMethodID = saved.ID
+		subscription.PaymentMethodTitle = saved.Title
+		NotifyUser(payment.UserID, fmt.Sprintf("🔁 Автопродление включено: способ оплаты %s сохранён.", saved.Title))
+	}
+}
+
+// HandleAutoRenewFailure учитывает неудачное автоматическое списание по платежу продления.
+func HandleAutoRenewFailure(payment db.Payment) {
+	if payment.SubscriptionID == nil {
+		return
+	}
+	var subscription db.Subscription
+	if err := db.DB.First(&subscription, *payment.SubscriptionID).Error; err != nil {
+		log.Printf("🔴 Подписка %d не найдена: %v", *payment.SubscriptionID, err)
+		return
+	}
+	registerAutoRenewFailure(subscription, "платеж отклонён")
+}
+
+// registerAutoRenewFailure увеличивает счётчик неудачных попыток автопродления и уведомляет
+// пользователя. После maxAutoRenewFailures попыток подряд автопродление отключается.
+func registerAutoRenewFailure(subscription db.Subscription, reason string) {
+	log.Printf("🔴 Неудачная попытка автопродления подписки %d: %s", subscription.ID, reason)
+
+	failures := subscription.AutoRenewFailures + 1
+	renewButton := []Button{{Text: "🔄 Продлить вручную", Data: fmt.Sprintf("renew_%d", subscription.ID)}}
+	if failures >= maxAutoRenewFailures {
+		if err := db.DB.Model(&subscription).Updates(map[string]interface{}{
+			"auto_renew":          false,
+			"auto_renew_failures": 0,
+		}).Error; err != nil {
+			log.Printf("🔴 Ошибка отключения автопродления подписки %d: %v", subscription.ID, err)
+		}
+		NotifyUserWithButtons(subscription.UserID,
+			"❌ Не удалось автоматически продлить подписку, автопродление отключено. Продлите подписку вручную, чтобы VPN продолжил работать.",
+			renewButton)
+		return
+	}
+
+	if err := db.DB.Model(&subscription).Update("auto_renew_failures", failures).Error; err != nil {
+		log.Printf("🔴 Ошибка обновления автопродления подписки %d: %v", subscription.ID, err)
+	}
+	NotifyUserWithButtons(subscription.UserID, fmt.Sprintf(
+		"⚠️ Не удалось списать оплату за автопродление подписки (попытка %d из %d). Мы повторим попытку позже – проверьте, что на карте достаточно средств.",
+		failures, maxAutoRenewFailures,
+	), renewButton)
+}
+
+// ProcessAutoRenewals списывает оплату с сохранённых способов оплаты для подписок
+// с включенным автопродлением, срок которых заканчивается в ближайшие дни.
+func ProcessAutoRenewals() {
+	now := time.Now()
+	var subscriptions []db.Subscription
+	err := db.DB.
+		Where("auto_renew = ? AND payment_method_id <> '' AND status = ?", true, db.SubscriptionActive).
+		Where("expires_at < ?", now.AddDate(0, 0, autoRenewDaysBefore())).
+		Where("auto_renew_attempt_at IS NULL OR auto_renew_attempt_at < ?", now.Add(-autoRenewRetryInterval)).
+		Find(&subscriptions).Error
+	if err != nil {
+		log.Printf("🔴 Ошибка выборки подписок для автопродления: %v", err)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		// Пропускаем подписки, по которым уже есть платеж в обработке.
+		var pending int64
+		if err := db.DB.Model(&db.Payment{}).
+			Where("subscription_id = ? AND status IN ?", subscription.ID, []string{db.PaymentPending, db.PaymentWaitingForCapture}).
+			Count(&pending).Error; err != nil {
+			log.Printf("🔴 Ошибка проверки платежей подписки %d: %v", subscription.ID, err)
+			continue
+		}
+		if pending > 0 {
+			continue
+		}
+		chargeSubscription(subscription)
+	}
+}
+
+// chargeSubscription создаёт платеж автопродления подписки с сохранённым способом оплаты.
+// Платеж записывается в БД до списания: если запись не удалась, деньги не списываются, а если
+// сбой случился после списания, платеж уже учтён и будет отправлен повторно с тем же ключом
+// идемпотентности.
+func chargeSubscription(subscription db.Subscription) {
+	now := time.Now()
+	if err := db.DB.Model(&subscription).Update("auto_renew_attempt_at", now).Error; err != nil {
+		log.Printf("🔴 Ошибка обновления подписки %d: %v", subscription.ID, err)
+		return
+	}
+
+	plan, err := renewalPlan(subscription)
+	if err != nil {
+		registerAutoRenewFailure(subscription, err.Error())
+		return
+	}
+	var user db.User
+	if err := db.DB.First(&user, subscription.UserID).Error; err != nil {
+		log.Printf("🔴 Пользователь %d не найден: %v", subscription.UserID, err)
+		return
+	}
+	quote := QuotePlan(&user, subscription.ServerID, *plan, nil)
+
+	payment := db.Payment{
+		UserID:         user.ID,
+		YooKassaID:     fmt.Sprintf("%s%d-%d", autoRenewPaymentPrefix, subscription.ID, now.UnixNano()),
+		Kind:           db.PaymentKindSubscription,
+		ServerID:       subscription.ServerID,
+		SubscriptionID: &subscription.ID,
+		PlanID:         &plan.ID,
+		Months:         plan.Months,
+		Amount:         quote.FinalPrice,
+		IsAutoRenew:    true,
+		Status:         db.PaymentPending,
+	}
+	if err := db.DB.Create(&payment).Error; err != nil {
+		log.Printf("🔴 Ошибка записи платежа автопродления подписки %d: %v", subscription.ID, err)
+		return
+	}
+	submitAutoRenewPayment(&payment, user, subscription.PaymentMethodID)
+}
+
+// submitAutoRenewPayment отправляет записанный платеж автопродления в Юкассу и применяет
+// полученный статус так же, как уведомление Юкассы. Временная ошибка оставляет платеж
+// в ожидании повторной отправки (CheckPendingPayments), остальные отменяют его.
+func submitAutoRenewPayment(payment *db.Payment, user db.User, paymentMethodID string) {
+	receipt, err := PaymentReceipt(&user, *payment, payment.Amount)
+	if err != nil {
+		log.Printf("🔴 Ошибка формирования чека платежа %s: %v", payment.YooKassaID, err)
+		cancelAutoRenewPayment(payment)
+		return
+	}
+
+	paymentResp, err := ChargeSavedPaymentMethod(payment.ID, user.ID, payment.Amount, paymentMethodID, receipt)
+	if err != nil {
+		var apiErr *YooKassaError
+		if errors.As(err, &apiErr) && !apiErr.Temporary() {
+			log.Printf("🔴 Юкасса отклонила платеж автопродления %s: %v", payment.YooKassaID, err)
+			cancelAutoRenewPayment(payment)
+			return
+		}
+		log.Printf("⚠️ Платеж автопродления %s не отправлен, повторим позже: %v", payment.YooKassaID, err)
+		return
+	}
+
+	if err := db.DB.Model(payment).Updates(map[string]interface{}{
+		"yoo_kassa_id":   paymentResp.ID,
+		"receipt_status": paymentResp.ReceiptRegistration,
+	}).Error; err != nil {
+		// Повторная отправка с тем же ключом идемпотентности вернёт этот же платеж.
+		log.Printf("🔴 Ошибка записи ID платежа автопродления %s (%s): %v", payment.YooKassaID, paymentResp.ID, err)
+		return
+	}
+	payment.YooKassaID = paymentResp.ID
+	payment.ReceiptStatus = paymentResp.ReceiptRegistration
+
+	// Незавершённые платежи и платежи, которые не удалось исполнить сразу, доведёт до конца
+	// проверка зависших платежей.
+	if _, err := ApplyPaymentStatus(payment, paymentResp.Status); err != nil {
+		log.Printf("🔴 Ошибка обработки платежа автопродления %s: %v", payment.YooKassaID, err)
+	}
+}
+
+// cancelAutoRenewPayment отменяет платеж автопродления, не созданный в Юкассе. Неудачная попытка
+// учитывается обработчиком отмены (HandleAutoRenewFailure).
+func cancelAutoRenewPayment(payment *db.Payment) {
+	if _, err := ApplyPaymentStatus(payment, db.PaymentCanceled); err != nil {
+		log.Printf("🔴 Ошибка отмены платежа автопродления %s: %v", payment.YooKassaID, err)
+	}
+}
+
+// isUnsentAutoRenewPayment сообщает, что платеж автопродления записан, но ещё не создан в Юкассе.
+func isUnsentAutoRenewPayment(payment db.Payment) bool {
+	return strings.HasPrefix(payment.YooKassaID, autoRenewPaymentPrefix)
+}
+
+// resubmitAutoRenewPayment повторно отправляет в Юкассу платеж автопродления, не дошедший до неё.
+// Платеж старше autoRenewResubmitWindow отменяется, а администратор получает просьбу сверить его
+// с личным кабинетом: ключ идемпотентности уже истёк.
+func resubmitAutoRenewPayment(payment db.Payment) {
+	if time.Since(payment.CreatedAt) > autoRenewResubmitWindow {
+		cancelAutoRenewPayment(&payment)
+		notifyAdmin(fmt.Sprintf("⚠️ Платеж автопродления #%d (пользователь %d, %.2f₽) не удалось отправить в Юкассу и он отменён. Проверьте в личном кабинете, не было ли списания.",
+			payment.ID, payment.UserID, payment.Amount))
+		return
+	}
+
+	var subscription db.Subscription
+	if err := db.DB.First(&subscription, *payment.SubscriptionID).Error; err != nil {
+		log.Printf("🔴 Подписка %d не найдена: %v", *payment.SubscriptionID, err)
+		return
+	}
+	var user db.User
+	if err := db.DB.First(&user, payment.UserID).Error; err != nil {
+		log.Printf("🔴 Пользователь %d не найден: %v", payment.UserID, err)
+		return
+	}
+	submitAutoRenewPayment(&payment, user, subscription.PaymentMethodID)
+}
+
+// renewalPlan подбирает тарифный план для автопродления: план с тем же сроком, что и у подписки,
+// а если такого нет – первый доступный план сервера.
+func renewalPlan(subscription db.Subscription) (*db.Plan, error) {
+	plans, err := ActivePlans(subscription.ServerID)
+	if err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("для сервера %d нет доступных тарифов", subscription.ServerID)
+	}
+	for i := range plans {
+		if plans[i].Months == subscription.Months {
+			return &plans[i], nil
+		}
+	}
+	return &plans[0], nil
+}
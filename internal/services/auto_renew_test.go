@@ -0,0 +1,117 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// createAutoRenewSubscription оформляет пользователю с контактом для чека подписку с сохранённым
+// способом оплаты и заводит для её сервера месячный тариф.
+func createAutoRenewSubscription(t *testing.T) (db.User, db.Subscription) {
+	t.Helper()
+	server, keys := createTestServer(t, 1)
+	plan := db.Plan{ServerID: &server.ID, Months: 1, Price: 100, IsActive: true}
+	if err := db.DB.Create(&plan).Error; err != nil {
+		t.Fatalf("ошибка создания тарифа: %v", err)
+	}
+	t.Cleanup(func() { db.DB.Delete(&plan) })
+
+	user := createTestUser(t, 0)
+	if err := db.DB.Model(&user).Update("email", "test@example.com").Error; err != nil {
+		t.Fatalf("ошибка сохранения email: %v", err)
+	}
+	user.Email = "test@example.com"
+	subscription := createTestSubscription(t, user, keys[0], time.Now().AddDate(0, 0, 1))
+	if err := db.DB.Model(&subscription).Updates(map[string]interface{}{
+		"auto_renew":        true,
+		"payment_method_id": "pm-test",
+	}).Error; err != nil {
+		t.Fatalf("ошибка включения автопродления: %v", err)
+	}
+	subscription.AutoRenew = true
+	subscription.PaymentMethodID = "pm-test"
+	return user, subscription
+}
+
+// autoRenewPayment возвращает единственный платеж автопродления подписки.
+func autoRenewPayment(t *testing.T, subscription db.Subscription) db.Payment {
+	t.Helper()
+	var payments []db.Payment
+	db.DB.Where("subscription_id = ? AND is_auto_renew = ?", subscription.ID, true).Find(&payments)
+	if len(payments) != 1 {
+		t.Fatalf("платежей автопродления: %d, ожидался 1", len(payments))
+	}
+	return payments[0]
+}
+
+// TestChargeSubscriptionRecordsPaymentBeforeCharge проверяет, что платеж автопродления записан
+// до списания и при сбое отправляется повторно с тем же ключом идемпотентности.
+func TestChargeSubscriptionRecordsPaymentBeforeCharge(t *testing.T) {
+	requireTestDB(t)
+	useFakeNotifier(t)
+	_, subscription := createAutoRenewSubscription(t)
+
+	yooKassaID := fmt.Sprintf("pay-auto-%d", testUnique())
+	var keys []string
+	useYooKassaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotence-Key"))
+		if len(keys) == 1 {
+			// Юкасса списала деньги, но ответ до бота не дошёл.
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%q,"status":"succeeded","amount":{"value":"100.00","currency":"RUB"}}`, yooKassaID)
+	})
+
+	chargeSubscription(subscription)
+	payment := autoRenewPayment(t, subscription)
+	if payment.Status != db.PaymentPending || !isUnsentAutoRenewPayment(payment) {
+		t.Fatalf("после сбоя платеж должен ждать повторной отправки: %+v", payment)
+	}
+
+	resubmitAutoRenewPayment(payment)
+	payment = autoRenewPayment(t, subscription)
+	if payment.Status != db.PaymentSucceeded || payment.YooKassaID != yooKassaID {
+		t.Errorf("платеж %s в статусе %s, ожидался %s в статусе succeeded", payment.YooKassaID, payment.Status, yooKassaID)
+	}
+	wantKey := fmt.Sprintf("charge-%d", payment.ID)
+	if len(keys) != 2 || keys[0] != wantKey || keys[1] != wantKey {
+		t.Errorf("ключи идемпотентности %v, ожидался дважды %s", keys, wantKey)
+	}
+
+	var extended db.Subscription
+	db.DB.First(&extended, subscription.ID)
+	if !extended.ExpiresAt.After(subscription.ExpiresAt.AddDate(0, 0, 27)) {
+		t.Errorf("подписка не продлена: истекает %v", extended.ExpiresAt)
+	}
+}
+
+// TestChargeSubscriptionDeclined проверяет, что отклонённое Юкассой списание отменяет платеж
+// и учитывается как неудачная попытка автопродления.
+func TestChargeSubscriptionDeclined(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	user, subscription := createAutoRenewSubscription(t)
+	useYooKassaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","code":"invalid_request","description":"Payment method is not available"}`))
+	})
+
+	chargeSubscription(subscription)
+
+	payment := autoRenewPayment(t, subscription)
+	if payment.Status != db.PaymentCanceled || !strings.HasPrefix(payment.YooKassaID, autoRenewPaymentPrefix) {
+		t.Errorf("платеж %s в статусе %s, ожидалась отмена неотправленного платежа", payment.YooKassaID, payment.Status)
+	}
+	var failed db.Subscription
+	db.DB.First(&failed, subscription.ID)
+	if failed.AutoRenewFailures != 1 {
+		t.Errorf("неудачных попыток %d, ожидалась 1", failed.AutoRenewFailures)
+	}
+	requireMessage(t, fake, user, "Не удалось списать оплату за автопродление")
+}
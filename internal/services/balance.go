@@ -0,0 +1,93 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Типы движения средств по балансу. Тип определяет системный счёт-источник.
+const (
+	BalanceTopUp    = "topup"    // Пополнение через Юкассу
+	BalanceReferral = "referral" // Бонус за приглашённого пользователя
+	BalanceRefund   = "refund"   // Возврат средств на баланс
+	BalanceAdmin    = "admin"    // Корректировка администратором
+	BalancePurchase = "purchase" // Оплата подписки с баланса
+)
+
+// ErrInsufficientBalance возвращается при попытке списать больше, чем есть на балансе.
+var ErrInsufficientBalance = errors.New("недостаточно средств на балансе")
+
+// userAccount возвращает имя счёта пользователя в журнале движения средств.
+func userAccount(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// systemAccount возвращает имя системного счёта для типа движения.
+func systemAccount(kind string) string {
+	return "system:" + kind
+}
+
+// transferBalance проводит движение средств по балансу пользователя в транзакции tx:
+// положительная сумма зачисляется, отрицательная – списывается. Пишет пару записей журнала
+// и обновляет кэшированный User.Balance. Уход баланса в минус запрещён.
+func transferBalance(tx *gorm.DB, userID int, amount float64, kind string, paymentID *int, comment string) error {
+	amount = roundPrice(amount)
+	if amount == 0 {
+		return nil
+	}
+
+	var user db.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "balance").
+		First(&user, userID).Error; err != nil {
+		return fmt.Errorf("пользователь %d не найден: %v", userID, err)
+	}
+	balance := roundPrice(user.Balance + amount)
+	if balance < 0 {
+		return ErrInsufficientBalance
+	}
+
+	transferID := fmt.Sprintf("%s-%d-%d", kind, userID, time.Now().UnixNano())
+	entries := []db.BalanceTransaction{
+		{TransferID: transferID, Account: userAccount(userID), UserID: &userID, Amount: amount, Kind: kind, PaymentID: paymentID, Comment: comment},
+		{TransferID: transferID, Account: systemAccount(kind), Amount: -amount, Kind: kind, PaymentID: paymentID, Comment: comment},
+	}
+	if err := tx.Create(&entries).Error; err != nil {
+		return fmt.Errorf("ошибка записи движения средств: %v", err)
+	}
+	return tx.Model(&user).Update("balance", balance).Error
+}
+
+// AdjustBalance зачисляет (amount > 0) или списывает (amount < 0) средства с баланса пользователя.
+func AdjustBalance(userID int, amount float64, kind string, paymentID *int, comment string) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		return transferBalance(tx, userID, amount, kind, paymentID, comment)
+	})
+}
+
+// CreateBalancePayment записывает платеж в БД и в той же транзакции списывает с баланса
+// его часть BalanceAmount и фиксирует применение промокода из quote. Если средств не хватает
+// или лимит промокода исчерпан, платеж не создаётся.
+func CreateBalancePayment(payment *db.Payment, quote Quote) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(payment).Error; err != nil {
+			return err
+		}
+		if err := transferBalance(tx, payment.UserID, -payment.BalanceAmount, BalancePurchase, &payment.ID, "Оплата подписки"); err != nil {
+			return err
+		}
+		return redeemPromoCode(tx, quote, payment.UserID, payment.ID)
+	})
+}
+
+// BalancePaymentID формирует идентификатор для платежа, полностью оплаченного с баланса,
+// у которого нет платежа в Юкассе.
+func BalancePaymentID(userID int) string {
+	return fmt.Sprintf("balance-%d-%d", userID, time.Now().UnixNano())
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Fulfillment описывает результат исполнения успешного платежа.
+type Fulfillment struct {
+	Payment      db.Payment
+	Subscription *db.Subscription // Оформленная или продлённая подписка; nil для пополнения баланса
+	Key          *db.VLESSKey     // Выданный ключ; nil, если новый ключ не выдавался
+	Referral     *db.Referral     // Приглашение, за которое начислен бонус; nil, если бонус не начислялся
+}
+
+// paymentSucceededHook – действие после исполнения успешного платежа.
+type paymentSucceededHook func(fulfillment Fulfillment)
+
+// paymentCanceledHook – действие после отмены платежа и снятия резервирования.
+type paymentCanceledHook func(payment db.Payment)
+
+// paymentSucceededHooks – действия после успешного платежа в порядке выполнения.
+var paymentSucceededHooks = []paymentSucceededHook{
+	deliverFulfillment,
+	saveAutoRenewMethod,
+	notifyReceipt,
+	notifyReferralHook,
+	alertAdminPayment,
+}
+
+// paymentCanceledHooks – действия после отменённого платежа в порядке выполнения.
+var paymentCanceledHooks = []paymentCanceledHook{
+	notifyPaymentCanceled,
+}
+
+// ApplyPaymentStatus переводит платеж в статус из Юкассы и в той же транзакции исполняет
+// или отменяет его: смена статуса и изменения БД фиксируются вместе, поэтому платеж исполняется
+// ровно один раз, а при ошибке остаётся в прежнем статусе и будет обработан повторно.
+// После фиксации выполняются действия paymentSucceededHooks или paymentCanceledHooks.
+// Возвращает true, если статус изменил этот вызов. Единая точка обработки для веб-хука,
+// проверки зависших платежей, автопродления и оплаты с баланса.
+func ApplyPaymentStatus(payment *db.Payment, status string) (bool, error) {
+	if status == db.PaymentPending {
+		return false, nil
+	}
+
+	var fulfillment *Fulfillment
+	var effect func(tx *gorm.DB) error
+	switch status {
+	case db.PaymentSucceeded:
+		effect = func(tx *gorm.DB) error {
+			var err error
+			if fulfillment, err = fulfill(tx, *payment); err != nil {
+				return err
+			}
+			// Бонус пригласившему начисляется вместе с исполнением платежа: при сбое
+			// оба действия повторятся при следующей обработке.
+			fulfillment.Referral, err = creditReferral(tx, *payment)
+			return err
+		}
+	case db.PaymentCanceled:
+		effect = func(tx *gorm.DB) error {
+			return cancel(tx, *payment)
+		}
+	}
+	// waiting_for_capture: деньги заблокированы, но ещё не списаны – резервирование сохраняется.
+
+	changed, err := TransitionPayment(payment, status, effect)
+	if err != nil {
+		if errors.Is(err, ErrInvalidPaymentTransition) {
+			return false, err
+		}
+		return false, fmt.Errorf("ошибка обработки платежа %s (%s): %w", payment.YooKassaID, status, err)
+	}
+	if !changed {
+		return false, nil
+	}
+
+	switch status {
+	case db.PaymentSucceeded:
+		fulfillment.Payment.Status = status
+		for _, hook := range paymentSucceededHooks {
+			hook(*fulfillment)
+		}
+	case db.PaymentCanceled:
+		for _, hook := range paymentCanceledHooks {
+			hook(*payment)
+		}
+	}
+	return true, nil
+}
+
+// fulfill выполняет в транзакции tx основное действие успешного платежа в зависимости
+// от его назначения: зачисляет пополнение, продлевает подписку или выдаёт зарезервированный ключ.
+func fulfill(tx *gorm.DB, payment db.Payment) (*Fulfillment, error) {
+	fulfillment := &Fulfillment{Payment: payment}
+
+	// Платеж пополнения зачисляется на баланс.
+	if payment.Kind == db.PaymentKindTopUp {
+		if err := transferBalance(tx, payment.UserID, payment.Amount, BalanceTopUp, &payment.ID, "Пополнение через Юкассу"); err != nil {
+			return nil, fmt.Errorf("ошибка зачисления пополнения: %v", err)
+		}
+		return fulfillment, nil
+	}
+
+	// Платеж продления не выдаёт новый ключ, а продлевает существующую подписку.
+	if payment.SubscriptionID != nil {
+		subscription, err := extendSubscription(tx, payment)
+		if err != nil {
+			return nil, err
+		}
+		fulfillment.Subscription = subscription
+		return fulfillment, nil
+	}
+
+	if payment.ReservedKeyID == nil {
+		return nil, fmt.Errorf("у платежа нет зарезервированного ключа")
+	}
+
+	var key db.VLESSKey
+	// Ищем именно тот ключ, который был зарезервирован под этот платеж за этим пользователем.
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ? AND user_id = ? AND is_used = false", *payment.ReservedKeyID, payment.UserID).
+		First(&key).Error
+	if err != nil {
+		return nil, fmt.Errorf("резервированный ключ %d не найден: %v", *payment.ReservedKeyID, err)
+	}
+
+	now := time.Now()
+	if err := tx.Model(&key).Updates(db.VLESSKey{
+		IsUsed:     true,
+		AssignedAt: &now,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("ошибка активации ключа: %v", err)
+	}
+	fulfillment.Key = &key
+
+	// Оформляем подписку с реальной датой окончания по оплаченному сроку.
+	subscription, err := createSubscription(tx, payment, key)
+	if err != nil {
+		return nil, err
+	}
+	fulfillment.Subscription = subscription
+	return fulfillment, nil
+}
+
+// cancel отменяет в транзакции tx неоплаченный платеж: возвращает на баланс списанную часть
+// суммы и снимает резервирование ключа.
+func cancel(tx *gorm.DB, payment db.Payment) error {
+	if payment.BalanceAmount > 0 {
+		if err := transferBalance(tx, payment.UserID, payment.BalanceAmount, BalanceRefund, &payment.ID, "Возврат по неоплаченному платежу"); err != nil {
+			return fmt.Errorf("ошибка возврата средств на баланс: %v", err)
+		}
+	}
+	if payment.Kind != db.PaymentKindTopUp && payment.SubscriptionID == nil {
+		if err := releaseReservedKey(tx, payment); err != nil {
+			return fmt.Errorf("ошибка снятия резервирования: %v", err)
+		}
+	}
+	return nil
+}
+
+// releaseReservedKey снимает резервирование ключа, если оплата не прошла.
+func releaseReservedKey(tx *gorm.DB, payment db.Payment) error {
+	if payment.ReservedKeyID == nil {
+		return fmt.Errorf("у платежа нет зарезервированного ключа")
+	}
+	return tx.Model(&db.VLESSKey{}).
+		Where("id = ? AND user_id = ? AND is_used = false", *payment.ReservedKeyID, payment.UserID).
+		Updates(map[string]interface{}{
+			"reserved_until": nil,
+			"user_id":        nil,
+		}).Error
+}
+
+// deliverFulfillment сообщает пользователю об успешной оплате и отправляет выданный ключ.
+func deliverFulfillment(fulfillment Fulfillment) {
+	payment := fulfillment.Payment
+	switch {
+	case payment.Kind == db.PaymentKindTopUp:
+		NotifyUser(payment.UserID, fmt.Sprintf("✅ Баланс пополнен на %.2f₽.", payment.Amount))
+	case fulfillment.Key != nil:
+		NotifyUser(payment.UserID, "✅ Оплата прошла успешно! Ваш VLESS-ключ активирован.")
+		if chatID, err := TelegramID(payment.UserID); err != nil {
+			log.Printf("🔴 Ошибка отправки ключа: %v", err)
+		} else {
+			DeliverVLESSKey(chatID, fulfillment.Key.Key)
+		}
+	case fulfillment.Subscription != nil:
+		NotifyUser(payment.UserID, fmt.Sprintf("✅ Оплата прошла успешно! Подписка продлена до %s.", fulfillment.Subscription.ExpiresAt.Format("02.01.2006")))
+	}
+}
+
+// saveAutoRenewMethod сохраняет способ оплаты для автопродления оплаченной подписки.
+// Выполняется после фиксации платежа: запрос к Юкассе не должен удерживать транзакцию.
+func saveAutoRenewMethod(fulfillment Fulfillment) {
+	if fulfillment.Subscription != nil {
+		UpdateAutoRenewAfterPayment(fulfillment.Payment, fulfillment.Subscription)
+	}
+}
+
+// notifyReceipt сообщает пользователю, куда придёт чек по платежу.
+func notifyReceipt(fulfillment Fulfillment) {
+	payment := fulfillment.Payment
+	if payment.ReceiptStatus == "" {
+		return
+	}
+	var user db.User
+	if err := db.DB.Select("id", "email", "phone").First(&user, payment.UserID).Error; err != nil {
+		log.Printf("🔴 Пользователь %d не найден: %v", payment.UserID, err)
+		return
+	}
+	NotifyUser(payment.UserID, fmt.Sprintf("🧾 Чек об оплате будет отправлен на %s.", ReceiptContact(&user)))
+}
+
+// notifyReferralHook сообщает пригласившему о бонусе, начисленном за этот платеж.
+func notifyReferralHook(fulfillment Fulfillment) {
+	if fulfillment.Referral != nil {
+		notifyReferralReward(*fulfillment.Referral)
+	}
+}
+
+// alertAdminPayment уведомляет администратора об успешном платеже, если включено ADMIN_PAYMENT_ALERTS.
+func alertAdminPayment(fulfillment Fulfillment) {
+	if os.Getenv("ADMIN_PAYMENT_ALERTS") != "true" {
+		return
+	}
+	payment := fulfillment.Payment
+	notifyAdmin(fmt.Sprintf("💰 Платеж %s (%s): %.2f₽ картой, %.2f₽ с баланса, пользователь %d",
+		payment.YooKassaID, payment.Kind, payment.Amount, payment.BalanceAmount, payment.UserID))
+}
+
+// notifyPaymentCanceled сообщает пользователю об отменённом платеже. Неудачное автосписание
+// учитывается отдельно: с повторами и отключением автопродления.
+func notifyPaymentCanceled(payment db.Payment) {
+	if payment.BalanceAmount > 0 {
+		NotifyUser(payment.UserID, fmt.Sprintf("💰 %.2f₽ возвращены на ваш баланс.", payment.BalanceAmount))
+	}
+	switch {
+	case payment.Kind == db.PaymentKindTopUp:
+		NotifyUser(payment.UserID, "❌ Пополнение баланса не прошло или было отменено.")
+	case payment.SubscriptionID != nil && payment.IsAutoRenew:
+		HandleAutoRenewFailure(payment)
+	case payment.SubscriptionID != nil:
+		// У платежа продления нет зарезервированного ключа.
+		NotifyUser(payment.UserID, "❌ Оплата продления не прошла или была отменена. Срок подписки не изменён.")
+	default:
+		NotifyUser(payment.UserID, "❌ Оплата не прошла или была отменена. Резервирование ключа снято.")
+	}
+}
+
+// notifyAdmin отправляет сообщение администратору из ADMIN_TELEGRAM_ID.
+func notifyAdmin(text string) {
+	adminID, err := strconv.ParseInt(os.Getenv("ADMIN_TELEGRAM_ID"), 10, 64)
+	if err != nil {
+		log.Printf("🔴 ADMIN_TELEGRAM_ID не задан, сообщение администратору не отправлено: %s", text)
+		return
+	}
+	SendMessage(adminID, text)
+}
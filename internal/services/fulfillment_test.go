@@ -0,0 +1,325 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// userMessages возвращает перехваченные сообщения, отправленные пользователю user.
+func userMessages(fake *FakeNotifier, user db.User) []FakeMessage {
+	var messages []FakeMessage
+	for _, message := range fake.Messages() {
+		if message.ChatID == user.TelegramID {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+// requireMessage проверяет, что пользователю отправлено сообщение, содержащее text.
+func requireMessage(t *testing.T, fake *FakeNotifier, user db.User, text string) FakeMessage {
+	t.Helper()
+	for _, message := range userMessages(fake, user) {
+		if strings.Contains(message.Text, text) {
+			return message
+		}
+	}
+	t.Fatalf("пользователю не отправлено сообщение %q, отправлены: %+v", text, userMessages(fake, user))
+	return FakeMessage{}
+}
+
+// reloadUser возвращает пользователя из БД.
+func reloadUser(t *testing.T, user db.User) db.User {
+	t.Helper()
+	if err := db.DB.First(&user, user.ID).Error; err != nil {
+		t.Fatalf("пользователь %d не найден: %v", user.ID, err)
+	}
+	return user
+}
+
+func TestApplyPaymentStatusTopUp(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	user := createTestUser(t, 0)
+	payment := createTestPayment(t, user, db.Payment{Kind: db.PaymentKindTopUp, Amount: 250})
+
+	changed, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded)
+	if err != nil || !changed {
+		t.Fatalf("ApplyPaymentStatus() = %v, %v, ожидалось true, nil", changed, err)
+	}
+	requireMessage(t, fake, user, "Баланс пополнен на 250.00₽")
+
+	// Повторное уведомление о том же платеже не зачисляет пополнение второй раз.
+	if changed, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded); err != nil || changed {
+		t.Fatalf("повторный ApplyPaymentStatus() = %v, %v, ожидалось false, nil", changed, err)
+	}
+	if balance := reloadUser(t, user).Balance; balance != 250 {
+		t.Errorf("баланс %.2f, ожидалось 250.00", balance)
+	}
+}
+
+func TestApplyPaymentStatusRenewal(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	_, keys := createTestServer(t, 1)
+	user := createTestUser(t, 0)
+	expiresAt := time.Now().AddDate(0, 0, 5).Truncate(time.Second)
+	subscription := createTestSubscription(t, user, keys[0], expiresAt)
+	payment := createTestPayment(t, user, db.Payment{SubscriptionID: &subscription.ID, Months: 1, Amount: 100})
+
+	if _, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded); err != nil {
+		t.Fatalf("ApplyPaymentStatus() вернул ошибку: %v", err)
+	}
+
+	if err := db.DB.First(&subscription, subscription.ID).Error; err != nil {
+		t.Fatalf("подписка не найдена: %v", err)
+	}
+	if want := expiresAt.AddDate(0, 1, 0); !subscription.ExpiresAt.Equal(want) {
+		t.Errorf("подписка истекает %s, ожидалось %s", subscription.ExpiresAt, want)
+	}
+	requireMessage(t, fake, user, "Подписка продлена до "+subscription.ExpiresAt.Format("02.01.2006"))
+}
+
+func TestApplyPaymentStatusNewKey(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	server, _ := createTestServer(t, 1)
+	user := createTestUser(t, 0)
+	key, err := ReserveKey(server.ID, user.ID, time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveKey() вернул ошибку: %v", err)
+	}
+	payment := createTestPayment(t, user, db.Payment{ServerID: server.ID, ReservedKeyID: &key.ID, Months: 1, Amount: 100})
+
+	if _, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded); err != nil {
+		t.Fatalf("ApplyPaymentStatus() вернул ошибку: %v", err)
+	}
+
+	if err := db.DB.First(key, key.ID).Error; err != nil {
+		t.Fatalf("ключ не найден: %v", err)
+	}
+	if !key.IsUsed || key.UserID == nil || *key.UserID != user.ID {
+		t.Errorf("ключ не выдан пользователю: %+v", key)
+	}
+	var subscription db.Subscription
+	if err := db.DB.Where("payment_id = ?", payment.ID).First(&subscription).Error; err != nil {
+		t.Fatalf("подписка не оформлена: %v", err)
+	}
+	if subscription.VLESSKeyID != key.ID || subscription.Status != db.SubscriptionActive {
+		t.Errorf("неожиданная подписка: %+v", subscription)
+	}
+	requireMessage(t, fake, user, "VLESS-ключ активирован")
+	requireMessage(t, fake, user, key.Key)
+}
+
+func TestApplyPaymentStatusMissingReservation(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	server, keys := createTestServer(t, 1)
+	user := createTestUser(t, 0)
+	// Ключ не зарезервирован за пользователем – выдавать его нельзя.
+	payment := createTestPayment(t, user, db.Payment{ServerID: server.ID, ReservedKeyID: &keys[0].ID, Months: 1, Amount: 100})
+
+	changed, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded)
+	if err == nil || changed {
+		t.Fatalf("ApplyPaymentStatus() = %v, %v, ожидалась ошибка", changed, err)
+	}
+
+	// Ошибка откатывает смену статуса: платеж обработается повторно.
+	var stored db.Payment
+	if err := db.DB.First(&stored, payment.ID).Error; err != nil {
+		t.Fatalf("платеж не найден: %v", err)
+	}
+	if stored.Status != db.PaymentPending {
+		t.Errorf("статус платежа %s, ожидался %s", stored.Status, db.PaymentPending)
+	}
+	var key db.VLESSKey
+	if err := db.DB.First(&key, keys[0].ID).Error; err != nil {
+		t.Fatalf("ключ не найден: %v", err)
+	}
+	if key.IsUsed || key.UserID != nil {
+		t.Errorf("ключ не должен выдаваться: %+v", key)
+	}
+	if messages := userMessages(fake, user); len(messages) != 0 {
+		t.Errorf("пользователю отправлены сообщения: %+v", messages)
+	}
+}
+
+func TestApplyPaymentStatusCancelReturnsBalance(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	server, _ := createTestServer(t, 1)
+	user := createTestUser(t, 100)
+	key, err := ReserveKey(server.ID, user.ID, time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveKey() вернул ошибку: %v", err)
+	}
+	payment := db.Payment{
+		UserID:        user.ID,
+		YooKassaID:    BalancePaymentID(user.ID),
+		Kind:          db.PaymentKindSubscription,
+		ServerID:      server.ID,
+		ReservedKeyID: &key.ID,
+		Months:        1,
+		Amount:        40,
+		BalanceAmount: 60,
+		Status:        db.PaymentPending,
+	}
+	if err := CreateBalancePayment(&payment, Quote{}); err != nil {
+		t.Fatalf("CreateBalancePayment() вернул ошибку: %v", err)
+	}
+	if balance := reloadUser(t, user).Balance; balance != 40 {
+		t.Fatalf("баланс после списания %.2f, ожидалось 40.00", balance)
+	}
+
+	if _, err := ApplyPaymentStatus(&payment, db.PaymentCanceled); err != nil {
+		t.Fatalf("ApplyPaymentStatus() вернул ошибку: %v", err)
+	}
+
+	if balance := reloadUser(t, user).Balance; balance != 100 {
+		t.Errorf("баланс после отмены %.2f, ожидалось 100.00", balance)
+	}
+	if err := db.DB.First(key, key.ID).Error; err != nil {
+		t.Fatalf("ключ не найден: %v", err)
+	}
+	if key.UserID != nil {
+		t.Errorf("резервирование ключа не снято: %+v", key)
+	}
+	requireMessage(t, fake, user, "60.00₽ возвращены на ваш баланс")
+	requireMessage(t, fake, user, "Резервирование ключа снято")
+}
+
+func TestApplyPaymentStatusAutoRenewFailure(t *testing.T) {
+	tests := []struct {
+		name          string
+		failures      int
+		wantFailures  int
+		wantAutoRenew bool
+		wantText      string
+	}{
+		{"первая неудача", 0, 1, true, "попытка 1 из 3"},
+		{"последняя неудача отключает автопродление", maxAutoRenewFailures - 1, 0, false, "автопродление отключено"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requireTestDB(t)
+			fake := useFakeNotifier(t)
+			_, keys := createTestServer(t, 1)
+			user := createTestUser(t, 0)
+			subscription := createTestSubscription(t, user, keys[0], time.Now().AddDate(0, 0, 2))
+			if err := db.DB.Model(&subscription).Updates(map[string]interface{}{
+				"auto_renew":          true,
+				"payment_method_id":   "pm-test",
+				"auto_renew_failures": tt.failures,
+			}).Error; err != nil {
+				t.Fatalf("ошибка включения автопродления: %v", err)
+			}
+			payment := createTestPayment(t, user, db.Payment{SubscriptionID: &subscription.ID, Months: 1, Amount: 100, IsAutoRenew: true})
+
+			if _, err := ApplyPaymentStatus(&payment, db.PaymentCanceled); err != nil {
+				t.Fatalf("ApplyPaymentStatus() вернул ошибку: %v", err)
+			}
+
+			if err := db.DB.First(&subscription, subscription.ID).Error; err != nil {
+				t.Fatalf("подписка не найдена: %v", err)
+			}
+			if subscription.AutoRenewFailures != tt.wantFailures || subscription.AutoRenew != tt.wantAutoRenew {
+				t.Errorf("неудачных попыток %d, автопродление %v; ожидалось %d, %v",
+					subscription.AutoRenewFailures, subscription.AutoRenew, tt.wantFailures, tt.wantAutoRenew)
+			}
+			message := requireMessage(t, fake, user, tt.wantText)
+			if len(message.Buttons) == 0 {
+				t.Errorf("в сообщении нет кнопки ручного продления")
+			}
+		})
+	}
+}
+
+// createTestReferral привязывает invitee к пригласившему inviter и удаляет привязку после теста.
+func createTestReferral(t *testing.T, inviter, invitee db.User) db.Referral {
+	t.Helper()
+	referral := db.Referral{InviterID: inviter.ID, InviteeID: invitee.ID}
+	if err := db.DB.Create(&referral).Error; err != nil {
+		t.Fatalf("ошибка создания приглашения: %v", err)
+	}
+	t.Cleanup(func() { db.DB.Delete(&referral) })
+	return referral
+}
+
+// TestApplyPaymentStatusCreditsReferral проверяет, что бонус пригласившему начисляется вместе
+// с исполнением платежа и только один раз.
+func TestApplyPaymentStatusCreditsReferral(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	t.Setenv("REFERRAL_BONUS_DAYS", "7")
+	t.Setenv("REFERRAL_BONUS_AMOUNT", "50")
+	_, keys := createTestServer(t, 1)
+	inviter := createTestUser(t, 0)
+	invitee := createTestUser(t, 0)
+	referral := createTestReferral(t, inviter, invitee)
+	subscription := createTestSubscription(t, invitee, keys[0], time.Now().AddDate(0, 0, 5))
+	payment := createTestPayment(t, invitee, db.Payment{SubscriptionID: &subscription.ID, Months: 1, Amount: 100})
+
+	if _, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded); err != nil {
+		t.Fatalf("ApplyPaymentStatus() вернул ошибку: %v", err)
+	}
+	if _, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded); err != nil {
+		t.Fatalf("повторный ApplyPaymentStatus() вернул ошибку: %v", err)
+	}
+
+	db.DB.First(&referral, referral.ID)
+	if referral.RewardedAt == nil || referral.RewardPaymentID == nil || *referral.RewardPaymentID != payment.ID {
+		t.Errorf("приглашение не вознаграждено за платеж %d: %+v", payment.ID, referral)
+	}
+	inviter = reloadUser(t, inviter)
+	if inviter.Balance != 50 || inviter.BonusDays != 7 {
+		t.Errorf("пригласившему начислено %.2f₽ и %d дней, ожидалось 50.00₽ и 7 дней", inviter.Balance, inviter.BonusDays)
+	}
+	requireMessage(t, fake, inviter, "Вам начислено бонусных дней: 7")
+}
+
+// TestReferralBonusSkipsTrialAndIsReversedByRefund проверяет, что бонусные дни не продлевают
+// пробную подписку пригласившего, а полный возврат платежа приглашённого отменяет бонус.
+func TestReferralBonusSkipsTrialAndIsReversedByRefund(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	t.Setenv("REFERRAL_BONUS_DAYS", "7")
+	t.Setenv("REFERRAL_BONUS_AMOUNT", "50")
+	_, keys := createTestServer(t, 2)
+	inviter := createTestUser(t, 0)
+	invitee := createTestUser(t, 0)
+	referral := createTestReferral(t, inviter, invitee)
+
+	trialExpiresAt := time.Now().AddDate(0, 0, 2).Truncate(time.Second)
+	trial := createTestSubscription(t, inviter, keys[0], trialExpiresAt)
+	db.DB.Model(&trial).Update("is_trial", true)
+	subscription := createTestSubscription(t, invitee, keys[1], time.Now().AddDate(0, 0, 5))
+	payment := createTestPayment(t, invitee, db.Payment{SubscriptionID: &subscription.ID, Months: 1, BalanceAmount: 100})
+
+	if _, err := ApplyPaymentStatus(&payment, db.PaymentSucceeded); err != nil {
+		t.Fatalf("ApplyPaymentStatus() вернул ошибку: %v", err)
+	}
+	db.DB.First(&trial, trial.ID)
+	if !trial.ExpiresAt.Equal(trialExpiresAt) {
+		t.Errorf("пробная подписка продлена до %s", trial.ExpiresAt)
+	}
+	if days := reloadUser(t, inviter).BonusDays; days != 7 {
+		t.Errorf("накоплено бонусных дней %d, ожидалось 7", days)
+	}
+
+	if _, err := RefundPayment(&payment, 0, "тест"); err != nil {
+		t.Fatalf("RefundPayment() вернул ошибку: %v", err)
+	}
+	db.DB.First(&referral, referral.ID)
+	if referral.ReversedAt == nil {
+		t.Errorf("бонус не отменён после полного возврата")
+	}
+	inviter = reloadUser(t, inviter)
+	if inviter.Balance != 0 || inviter.BonusDays != 0 {
+		t.Errorf("после отмены у пригласившего %.2f₽ и %d дней, ожидалось 0", inviter.Balance, inviter.BonusDays)
+	}
+	requireMessage(t, fake, inviter, "реферальный бонус отменён")
+}
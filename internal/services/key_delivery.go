@@ -0,0 +1,43 @@
+package services
+
+import (
+	"fmt"
+	"log"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// keyInstructions – инструкции по импорту VLESS-ключа в популярные клиенты.
+const keyInstructions = `📲 *Как подключиться*
+
+*Android* – v2rayNG или Hiddify:
+нажмите «+» → «Импорт из буфера обмена» (или «Сканировать QR-код»).
+
+*iOS / macOS* – Streisand, V2Box или Hiddify:
+нажмите «+» → «Добавить из буфера» (или отсканируйте QR-код).
+
+*Windows / Linux* – Hiddify или Nekoray:
+«Добавить профиль» → «Из буфера обмена».
+
+После импорта выберите профиль и нажмите «Подключиться».`
+
+// DeliverVLESSKey отправляет пользователю VLESS-ссылку для копирования, QR-код и инструкции по подключению.
+func DeliverVLESSKey(chatID int64, link string) {
+	n := currentNotifier()
+
+	text := fmt.Sprintf("🔑 Ваш VLESS-ключ (нажмите, чтобы скопировать):\n\n`%s`", link)
+	if err := n.SendMarkdown(chatID, text); err != nil {
+		log.Printf("🔴 Ошибка отправки VLESS-ключа пользователю %d: %v", chatID, err)
+	}
+
+	png, err := qrcode.Encode(link, qrcode.Medium, 512)
+	if err != nil {
+		log.Printf("🔴 Ошибка генерации QR-кода для пользователя %d: %v", chatID, err)
+	} else if err := n.SendPhoto(chatID, png, "📷 Отсканируйте QR-код в VPN-клиенте"); err != nil {
+		log.Printf("🔴 Ошибка отправки QR-кода пользователю %d: %v", chatID, err)
+	}
+
+	if err := n.SendMarkdown(chatID, keyInstructions); err != nil {
+		log.Printf("🔴 Ошибка отправки инструкций пользователю %d: %v", chatID, err)
+	}
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReserveKey атомарно резервирует свободный VLESS-ключ сервера за пользователем на время ttl,
+// за которое под ключ должен быть создан платеж; дальше резервирование держит сам платеж.
+// Выборка идёт через SELECT ... FOR UPDATE SKIP LOCKED, поэтому параллельные покупки
+// получают разные ключи. Если свободных ключей нет, возвращается gorm.ErrRecordNotFound.
+func ReserveKey(serverID, userID int, ttl time.Duration) (*db.VLESSKey, error) {
+	var key db.VLESSKey
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockFreeKey(tx, serverID, &key); err != nil {
+			return err
+		}
+
+		reservedUntil := time.Now().Add(ttl)
+		return tx.Model(&key).Updates(map[string]interface{}{
+			"reserved_until": reservedUntil,
+			"user_id":        userID,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// lockFreeKey выбирает свободный ключ сервера и блокирует его строку до конца транзакции tx.
+// Строки, заблокированные другими транзакциями, пропускаются. Ключ, под который есть незавершённый
+// платеж, считается занятым и после истечения reserved_until: платеж в Юкассе можно оплатить
+// гораздо позже, и ключ должен достаться именно этому покупателю.
+func lockFreeKey(tx *gorm.DB, serverID int, key *db.VLESSKey) error {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+		Where("server_id = ? AND is_used = false AND (reserved_until IS NULL OR reserved_until < NOW())", serverID).
+		Where("NOT EXISTS (SELECT 1 FROM payments WHERE payments.reserved_key_id = vless_keys.id AND payments.status IN ?)",
+			[]string{db.PaymentPending, db.PaymentWaitingForCapture}).
+		Order("id").
+		First(key).Error
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// TestReserveKeyConcurrent запускает одновременные покупки на сервере, где ключей меньше,
+// чем покупателей, и проверяет, что ни один ключ не достался двоим.
+func TestReserveKeyConcurrent(t *testing.T) {
+	requireTestDB(t)
+
+	const keys, buyers = 5, 20
+	server, _ := createTestServer(t, keys)
+	users := make([]db.User, buyers)
+	for i := range users {
+		users[i] = createTestUser(t, 0)
+	}
+
+	type reservation struct {
+		userID int
+		key    *db.VLESSKey
+		err    error
+	}
+	results := make(chan reservation, buyers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, user := range users {
+		wg.Add(1)
+		go func(userID int) {
+			defer wg.Done()
+			<-start
+			key, err := ReserveKey(server.ID, userID, time.Minute)
+			results <- reservation{userID: userID, key: key, err: err}
+		}(user.ID)
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	owners := make(map[int]int)
+	soldOut := 0
+	for r := range results {
+		if errors.Is(r.err, gorm.ErrRecordNotFound) {
+			soldOut++
+			continue
+		}
+		if r.err != nil {
+			t.Fatalf("ошибка резервирования: %v", r.err)
+		}
+		if owner, taken := owners[r.key.ID]; taken {
+			t.Errorf("ключ %d зарезервирован дважды: пользователями %d и %d", r.key.ID, owner, r.userID)
+		}
+		owners[r.key.ID] = r.userID
+	}
+	if len(owners) != keys || soldOut != buyers-keys {
+		t.Errorf("зарезервировано ключей: %d, отказов: %d; ожидалось %d и %d", len(owners), soldOut, keys, buyers-keys)
+	}
+
+	var stored []db.VLESSKey
+	if err := db.DB.Where("server_id = ?", server.ID).Find(&stored).Error; err != nil {
+		t.Fatalf("ошибка чтения ключей: %v", err)
+	}
+	for _, key := range stored {
+		if key.UserID == nil || *key.UserID != owners[key.ID] {
+			t.Errorf("ключ %d закреплён за %v, а выдан пользователю %d", key.ID, key.UserID, owners[key.ID])
+		}
+	}
+}
+
+// TestReserveKeySkipsKeysWithUnfinishedPayment проверяет, что ключ с незавершённым платежом
+// не достаётся другому покупателю даже после истечения reserved_until.
+func TestReserveKeySkipsKeysWithUnfinishedPayment(t *testing.T) {
+	requireTestDB(t)
+
+	server, keys := createTestServer(t, 1)
+	first := createTestUser(t, 0)
+	second := createTestUser(t, 0)
+
+	key, err := ReserveKey(server.ID, first.ID, -time.Minute)
+	if err != nil {
+		t.Fatalf("ошибка резервирования: %v", err)
+	}
+	payment := db.Payment{UserID: first.ID, YooKassaID: "test-" + keys[0].Key, ServerID: server.ID, ReservedKeyID: &key.ID, Status: db.PaymentPending}
+	if err := db.DB.Create(&payment).Error; err != nil {
+		t.Fatalf("ошибка создания платежа: %v", err)
+	}
+
+	if _, err := ReserveKey(server.ID, second.ID, time.Minute); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("ключ с незавершённым платежом выдан другому покупателю: %v", err)
+	}
+
+	if err := db.DB.Model(&payment).Update("status", db.PaymentCanceled).Error; err != nil {
+		t.Fatalf("ошибка отмены платежа: %v", err)
+	}
+	if _, err := ReserveKey(server.ID, second.ID, time.Minute); err != nil {
+		t.Fatalf("ключ отменённого платежа не освободился: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// ErrKeyNotRetired возвращается ReissueKey, если ключ не выведен из оборота.
+var ErrKeyNotRetired = errors.New("ключ не выведен из оборота")
+
+// retireKey в транзакции tx снимает ключ с пользователя и выводит его из оборота. Ключ остаётся
+// помеченным как занятый, поэтому не попадёт к новому покупателю, пока администратор не
+// перевыпустит его в панели сервера и не вернёт в пул через ReissueKey.
+func retireKey(tx *gorm.DB, keyID int) error {
+	return tx.Model(&db.VLESSKey{}).Where("id = ?", keyID).Updates(map[string]interface{}{
+		"is_used":        true,
+		"user_id":        nil,
+		"assigned_at":    nil,
+		"reserved_until": nil,
+		"retired_at":     time.Now(),
+	}).Error
+}
+
+// RetiredKeys возвращает выведенные из оборота ключи, ожидающие перевыпуска, начиная с давних.
+func RetiredKeys() ([]db.VLESSKey, error) {
+	var keys []db.VLESSKey
+	if err := db.DB.Where("retired_at IS NOT NULL").Order("retired_at").Find(&keys).Error; err != nil {
+		return nil, fmt.Errorf("ошибка получения выведенных ключей: %v", err)
+	}
+	return keys, nil
+}
+
+// ReissueKey возвращает выведенный из оборота ключ в пул свободных ключей с новой VLESS-ссылкой,
+// выпущенной в панели сервера. Прежняя ссылка должна быть отозвана на сервере заранее.
+func ReissueKey(keyID int, link string) error {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, "vless://") {
+		return fmt.Errorf("ссылка должна начинаться с vless://")
+	}
+
+	result := db.DB.Model(&db.VLESSKey{}).
+		Where("id = ? AND retired_at IS NOT NULL AND key <> ?", keyID, link).
+		Updates(map[string]interface{}{
+			"key":        link,
+			"is_used":    false,
+			"retired_at": nil,
+		})
+	if result.Error != nil {
+		return fmt.Errorf("ошибка перевыпуска ключа %d: %v", keyID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		var key db.VLESSKey
+		if err := db.DB.Select("id", "key", "retired_at").First(&key, keyID).Error; err != nil {
+			return fmt.Errorf("ключ %d не найден: %v", keyID, err)
+		}
+		if key.RetiredAt == nil {
+			return ErrKeyNotRetired
+		}
+		return fmt.Errorf("новая ссылка ключа %d совпадает с прежней", keyID)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// TestRetiredKeyIsNotReservedUntilReissued проверяет, что выведенный из оборота ключ не
+// достаётся новому покупателю, пока его не перевыпустят.
+func TestRetiredKeyIsNotReservedUntilReissued(t *testing.T) {
+	requireTestDB(t)
+	server, keys := createTestServer(t, 1)
+	user := createTestUser(t, 0)
+	if err := retireKey(db.DB, keys[0].ID); err != nil {
+		t.Fatalf("retireKey() вернул ошибку: %v", err)
+	}
+
+	if _, err := ReserveKey(server.ID, user.ID, time.Minute); err == nil {
+		t.Fatalf("ReserveKey() выдал выведенный из оборота ключ")
+	}
+	if err := ReissueKey(keys[0].ID, keys[0].Key); err == nil {
+		t.Errorf("ReissueKey() принял прежнюю ссылку")
+	}
+
+	link := keys[0].Key + "-reissued"
+	if err := ReissueKey(keys[0].ID, link); err != nil {
+		t.Fatalf("ReissueKey() вернул ошибку: %v", err)
+	}
+	if err := ReissueKey(keys[0].ID, link+"-again"); !errors.Is(err, ErrKeyNotRetired) {
+		t.Errorf("повторный ReissueKey() = %v, ожидалась ErrKeyNotRetired", err)
+	}
+	key, err := ReserveKey(server.ID, user.ID, time.Minute)
+	if err != nil {
+		t.Fatalf("ReserveKey() не выдал перевыпущенный ключ: %v", err)
+	}
+	if key.ID != keys[0].ID || key.Key != link {
+		t.Errorf("выдан ключ %+v, ожидался перевыпущенный #%d", key, keys[0].ID)
+	}
+}
@@ -0,0 +1,176 @@
+package services
+
+import (
+	"log"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Button – inline-кнопка уведомления с callback-данными.
+type Button struct {
+	Text string
+	Data string
+}
+
+// Notifier доставляет уведомления пользователям.
+type Notifier interface {
+	// SendMessage отправляет текстовое сообщение в чат.
+	SendMessage(chatID int64, text string) error
+	// SendMarkdown отправляет сообщение с разметкой Markdown.
+	SendMarkdown(chatID int64, text string) error
+	// SendPhoto отправляет PNG-изображение с подписью.
+	SendPhoto(chatID int64, png []byte, caption string) error
+	// SendButtons отправляет сообщение с inline-кнопками, по одной в ряд.
+	SendButtons(chatID int64, text string, buttons []Button) error
+}
+
+var (
+	notifierMu sync.RWMutex
+	notifier   Notifier = LogNotifier{}
+)
+
+// SetNotifier задаёт реализацию доставки уведомлений. Вызывается при старте бота.
+func SetNotifier(n Notifier) {
+	notifierMu.Lock()
+	defer notifierMu.Unlock()
+	notifier = n
+}
+
+// currentNotifier возвращает текущую реализацию доставки уведомлений.
+func currentNotifier() Notifier {
+	notifierMu.RLock()
+	defer notifierMu.RUnlock()
+	return notifier
+}
+
+// SendMessage отправляет сообщение пользователю через настроенный Notifier.
+func SendMessage(chatID int64, text string) {
+	if err := currentNotifier().SendMessage(chatID, text); err != nil {
+		log.Printf("🔴 Ошибка отправки сообщения пользователю %d: %v", chatID, err)
+	}
+}
+
+// TelegramNotifier отправляет уведомления через Telegram Bot API.
+type TelegramNotifier struct {
+	bot *tgbotapi.BotAPI
+}
+
+// NewTelegramNotifier создаёт Notifier поверх запущенного бота.
+func NewTelegramNotifier(bot *tgbotapi.BotAPI) *TelegramNotifier {
+	return &TelegramNotifier{bot: bot}
+}
+
+// SendMessage отправляет текстовое сообщение через Telegram.
+func (n *TelegramNotifier) SendMessage(chatID int64, text string) error {
+	_, err := n.bot.Send(tgbotapi.NewMessage(chatID, text))
+	return err
+}
+
+// SendMarkdown отправляет сообщение с разметкой Markdown через Telegram.
+func (n *TelegramNotifier) SendMarkdown(chatID int64, text string) error {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ParseMode = "Markdown"
+	_, err := n.bot.Send(msg)
+	return err
+}
+
+// SendPhoto отправляет PNG-изображение через Telegram.
+func (n *TelegramNotifier) SendPhoto(chatID int64, png []byte, caption string) error {
+	photo := tgbotapi.NewPhotoUpload(chatID, tgbotapi.FileBytes{Name: "image.png", Bytes: png})
+	photo.Caption = caption
+	_, err := n.bot.Send(photo)
+	return err
+}
+
+// SendButtons отправляет сообщение с inline-кнопками через Telegram.
+func (n *TelegramNotifier) SendButtons(chatID int64, text string, buttons []Button) error {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for _, b := range buttons {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(b.Text, b.Data)))
+	}
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	_, err := n.bot.Send(msg)
+	return err
+}
+
+// LogNotifier только логирует уведомления. Используется, пока бот не запущен.
+type LogNotifier struct{}
+
+// SendMessage записывает сообщение в лог.
+func (LogNotifier) SendMessage(chatID int64, text string) error {
+	log.Printf("Отправка сообщения пользователю %d: %s", chatID, text)
+	return nil
+}
+
+// SendMarkdown записывает сообщение в лог.
+func (l LogNotifier) SendMarkdown(chatID int64, text string) error {
+	return l.SendMessage(chatID, text)
+}
+
+// SendPhoto записывает в лог факт отправки изображения.
+func (LogNotifier) SendPhoto(chatID int64, png []byte, caption string) error {
+	log.Printf("Отправка изображения (%d байт) пользователю %d: %s", len(png), chatID, caption)
+	return nil
+}
+
+// SendButtons записывает сообщение в лог.
+func (l LogNotifier) SendButtons(chatID int64, text string, buttons []Button) error {
+	return l.SendMessage(chatID, text)
+}
+
+// FakeMessage – сообщение, перехваченное FakeNotifier.
+type FakeMessage struct {
+	ChatID   int64
+	Text     string   // Текст сообщения или подпись изображения
+	Markdown bool     // Сообщение отправлено с разметкой Markdown
+	Photo    []byte   // PNG-изображение, если было отправлено фото
+	Buttons  []Button // Inline-кнопки сообщения
+}
+
+// FakeNotifier запоминает отправленные уведомления вместо доставки. Предназначен для тестов.
+type FakeNotifier struct {
+	mu       sync.Mutex
+	messages []FakeMessage
+	Err      error // Ошибка, которую возвращают методы отправки
+}
+
+// SendMessage запоминает сообщение.
+func (n *FakeNotifier) SendMessage(chatID int64, text string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, FakeMessage{ChatID: chatID, Text: text})
+	return n.Err
+}
+
+// SendMarkdown запоминает сообщение с разметкой.
+func (n *FakeNotifier) SendMarkdown(chatID int64, text string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, FakeMessage{ChatID: chatID, Text: text, Markdown: true})
+	return n.Err
+}
+
+// SendPhoto запоминает изображение.
+func (n *FakeNotifier) SendPhoto(chatID int64, png []byte, caption string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, FakeMessage{ChatID: chatID, Text: caption, Photo: png})
+	return n.Err
+}
+
+// SendButtons запоминает сообщение с кнопками.
+func (n *FakeNotifier) SendButtons(chatID int64, text string, buttons []Button) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, FakeMessage{ChatID: chatID, Text: text, Buttons: buttons})
+	return n.Err
+}
+
+// Messages возвращает копию перехваченных сообщений.
+func (n *FakeNotifier) Messages() []FakeMessage {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]FakeMessage(nil), n.messages...)
+}
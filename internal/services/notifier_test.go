@@ -0,0 +1,68 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// useFakeNotifier подменяет Notifier на FakeNotifier до конца теста.
+func useFakeNotifier(t *testing.T) *FakeNotifier {
+	t.Helper()
+	previous := currentNotifier()
+	fake := &FakeNotifier{}
+	SetNotifier(fake)
+	t.Cleanup(func() { SetNotifier(previous) })
+	return fake
+}
+
+func TestSendMessage(t *testing.T) {
+	fake := useFakeNotifier(t)
+
+	SendMessage(42, "привет")
+
+	messages := fake.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("отправлено сообщений: %d, ожидалось 1", len(messages))
+	}
+	if messages[0].ChatID != 42 || messages[0].Text != "привет" || messages[0].Markdown {
+		t.Errorf("неожиданное сообщение: %+v", messages[0])
+	}
+}
+
+func TestSendMessageIgnoresDeliveryError(t *testing.T) {
+	fake := useFakeNotifier(t)
+	fake.Err = errors.New("бот заблокирован пользователем")
+
+	SendMessage(42, "привет")
+
+	if len(fake.Messages()) != 1 {
+		t.Fatalf("сообщение не было передано в Notifier")
+	}
+}
+
+func TestDeliverVLESSKey(t *testing.T) {
+	fake := useFakeNotifier(t)
+	link := "vless://uuid@example.com:443?security=reality#vpn"
+
+	DeliverVLESSKey(7, link)
+
+	messages := fake.Messages()
+	if len(messages) != 3 {
+		t.Fatalf("отправлено сообщений: %d, ожидалось 3 (ключ, QR-код, инструкции)", len(messages))
+	}
+	for _, message := range messages {
+		if message.ChatID != 7 {
+			t.Errorf("сообщение отправлено в чат %d вместо 7", message.ChatID)
+		}
+	}
+	if !messages[0].Markdown || !strings.Contains(messages[0].Text, "`"+link+"`") {
+		t.Errorf("ключ должен отправляться моноширинным текстом: %+v", messages[0])
+	}
+	if len(messages[1].Photo) == 0 {
+		t.Errorf("второе сообщение должно содержать QR-код")
+	}
+	if !messages[2].Markdown || messages[2].Text != keyInstructions {
+		t.Errorf("третье сообщение должно содержать инструкции: %+v", messages[2])
+	}
+}
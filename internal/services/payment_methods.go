@@ -0,0 +1,79 @@
+package services
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// PaymentMethod описывает способ оплаты, который пользователь может выбрать в боте.
+type PaymentMethod struct {
+	Code  string // Короткий код для callback-данных и YOOKASSA_PAYMENT_METHODS
+	Type  string // Тип способа оплаты в API Юкассы (payment_method_data.type)
+	Label string // Подпись кнопки
+	// Recurring – способ можно сохранить для автопродления (save_payment_method).
+	Recurring bool
+}
+
+// paymentMethods – все поддерживаемые способы оплаты в порядке вывода.
+var paymentMethods = []PaymentMethod{
+	{Code: "card", Type: "bank_card", Label: "💳 Банковская карта", Recurring: true},
+	{Code: "sbp", Type: "sbp", Label: "⚡ СБП"},
+	{Code: "yoomoney", Type: "yoo_money", Label: "👛 ЮMoney", Recurring: true},
+}
+
+// defaultPaymentMethods – способы оплаты, если YOOKASSA_PAYMENT_METHODS не задан.
+const defaultPaymentMethods = "card"
+
+// EnabledPaymentMethods возвращает способы оплаты, включенные в YOOKASSA_PAYMENT_METHODS
+// (коды через запятую, например "card,sbp,yoomoney").
+func EnabledPaymentMethods() []PaymentMethod {
+	value := os.Getenv("YOOKASSA_PAYMENT_METHODS")
+	if value == "" {
+		value = defaultPaymentMethods
+	}
+
+	var enabled []PaymentMethod
+	for _, code := range strings.Split(value, ",") {
+		code = strings.TrimSpace(code)
+		method, ok := findPaymentMethod(code)
+		if !ok {
+			log.Printf("🔴 Неизвестный способ оплаты в YOOKASSA_PAYMENT_METHODS: %q", code)
+			continue
+		}
+		enabled = append(enabled, method)
+	}
+	if len(enabled) == 0 {
+		method, _ := findPaymentMethod(defaultPaymentMethods)
+		enabled = append(enabled, method)
+	}
+	return enabled
+}
+
+// findPaymentMethod ищет способ оплаты по коду среди всех поддерживаемых.
+func findPaymentMethod(code string) (PaymentMethod, bool) {
+	for _, method := range paymentMethods {
+		if method.Code == code {
+			return method, true
+		}
+	}
+	return PaymentMethod{}, false
+}
+
+// EnabledPaymentMethod возвращает включенный способ оплаты по выбранному пользователем коду.
+// Пустой или выключенный код означает первый включенный способ оплаты.
+func EnabledPaymentMethod(code string) PaymentMethod {
+	enabled := EnabledPaymentMethods()
+	for _, method := range enabled {
+		if method.Code == code {
+			return method
+		}
+	}
+	return enabled[0]
+}
+
+// PaymentMethodType возвращает тип способа оплаты Юкассы для выбранного пользователем кода.
+// Пустой или выключенный код означает первый включенный способ оплаты.
+func PaymentMethodType(code string) string {
+	return EnabledPaymentMethod(code).Type
+}
@@ -0,0 +1,27 @@
+package services
+
+import "testing"
+
+func TestEnabledPaymentMethod(t *testing.T) {
+	t.Setenv("YOOKASSA_PAYMENT_METHODS", "sbp,card")
+
+	tests := []struct {
+		code          string
+		wantType      string
+		wantRecurring bool
+	}{
+		{"card", "bank_card", true},
+		{"sbp", "sbp", false},
+		{"", "sbp", false},         // не выбран – первый включенный
+		{"yoomoney", "sbp", false}, // выключен – первый включенный
+	}
+	for _, tt := range tests {
+		method := EnabledPaymentMethod(tt.code)
+		if method.Type != tt.wantType || method.Recurring != tt.wantRecurring {
+			t.Errorf("EnabledPaymentMethod(%q) = %+v, ожидался тип %s, Recurring %v", tt.code, method, tt.wantType, tt.wantRecurring)
+		}
+		if got := PaymentMethodType(tt.code); got != tt.wantType {
+			t.Errorf("PaymentMethodType(%q) = %s, ожидалось %s", tt.code, got, tt.wantType)
+		}
+	}
+}
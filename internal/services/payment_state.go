@@ -0,0 +1,79 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// paymentTransitions – допустимые переходы между статусами платежа.
+var paymentTransitions = map[string][]string{
+	db.PaymentPending:           {db.PaymentWaitingForCapture, db.PaymentSucceeded, db.PaymentCanceled},
+	db.PaymentWaitingForCapture: {db.PaymentSucceeded, db.PaymentCanceled},
+	db.PaymentSucceeded:         {db.PaymentRefunded},
+}
+
+// ErrInvalidPaymentTransition возвращается при попытке недопустимого перехода статуса платежа,
+// например из canceled в succeeded.
+var ErrInvalidPaymentTransition = errors.New("недопустимый переход статуса платежа")
+
+// CanTransitionPayment сообщает, допустим ли переход платежа из статуса from в статус to.
+func CanTransitionPayment(from, to string) bool {
+	for _, allowed := range paymentTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionPayment переводит платеж в статус to под блокировкой строки платежа и в той же
+// транзакции выполняет effect – изменения БД, которые сопровождают переход (выдача ключа,
+// снятие резервирования); effect может быть nil. Возвращает true, только если статус изменил
+// именно этот вызов: повторное уведомление или параллельная проверка того же платежа получат
+// false, поэтому effect выполняется ровно один раз. Если effect вернул ошибку, транзакция
+// откатывается вместе со сменой статуса, и следующая обработка платежа повторит переход.
+func TransitionPayment(payment *db.Payment, to string, effect func(tx *gorm.DB) error) (bool, error) {
+	return transitionPayment(db.DB, payment, to, effect)
+}
+
+// transitionPayment выполняет TransitionPayment в соединении или транзакции conn. Внутри
+// транзакции переход выполняется во вложенной транзакции (точке сохранения) и фиксируется
+// вместе с внешней.
+func transitionPayment(conn *gorm.DB, payment *db.Payment, to string, effect func(tx *gorm.DB) error) (bool, error) {
+	changed := false
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		var current db.Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "status").
+			First(&current, payment.ID).Error; err != nil {
+			return fmt.Errorf("платеж %d не найден: %v", payment.ID, err)
+		}
+		payment.Status = current.Status
+		if current.Status == to {
+			return nil
+		}
+		if !CanTransitionPayment(current.Status, to) {
+			return fmt.Errorf("%w: %s → %s (платеж %s)", ErrInvalidPaymentTransition, current.Status, to, payment.YooKassaID)
+		}
+		if err := tx.Model(&current).Update("status", to).Error; err != nil {
+			return fmt.Errorf("ошибка обновления статуса платежа %s: %v", payment.YooKassaID, err)
+		}
+		if effect != nil {
+			if err := effect(tx); err != nil {
+				return err
+			}
+		}
+		changed = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	payment.Status = to
+	return changed, nil
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"testing"
+
+	"vpn-bot/internal/db"
+)
+
+func TestCanTransitionPayment(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{db.PaymentPending, db.PaymentWaitingForCapture, true},
+		{db.PaymentPending, db.PaymentSucceeded, true},
+		{db.PaymentPending, db.PaymentCanceled, true},
+		{db.PaymentWaitingForCapture, db.PaymentSucceeded, true},
+		{db.PaymentWaitingForCapture, db.PaymentCanceled, true},
+		{db.PaymentSucceeded, db.PaymentRefunded, true},
+		{db.PaymentPending, db.PaymentRefunded, false},
+		{db.PaymentWaitingForCapture, db.PaymentPending, false},
+		{db.PaymentSucceeded, db.PaymentCanceled, false},
+		{db.PaymentSucceeded, db.PaymentPending, false},
+		{db.PaymentCanceled, db.PaymentSucceeded, false},
+		{db.PaymentRefunded, db.PaymentSucceeded, false},
+		{db.PaymentSucceeded, db.PaymentSucceeded, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransitionPayment(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransitionPayment(%s, %s) = %v, ожидалось %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"fmt"
+
+	"vpn-bot/internal/db"
+)
+
+// ActivePlans возвращает активные тарифные планы сервера в порядке вывода.
+// Если у сервера нет собственных планов, возвращаются глобальные.
+func ActivePlans(serverID int) ([]db.Plan, error) {
+	var plans []db.Plan
+	err := db.DB.Where("server_id = ? AND is_active = ?", serverID, true).
+		Order("sort_order, months").
+		Find(&plans).Error
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения планов сервера %d: %v", serverID, err)
+	}
+	if len(plans) > 0 {
+		return plans, nil
+	}
+
+	err = db.DB.Where("server_id IS NULL AND is_active = ?", true).
+		Order("sort_order, months").
+		Find(&plans).Error
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения глобальных планов: %v", err)
+	}
+	return plans, nil
+}
+
+// FindPlan возвращает активный план, доступный для покупки на указанном сервере.
+func FindPlan(serverID, planID int) (*db.Plan, error) {
+	plans, err := ActivePlans(serverID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range plans {
+		if plans[i].ID == planID {
+			return &plans[i], nil
+		}
+	}
+	return nil, fmt.Errorf("план %d недоступен для сервера %d", planID, serverID)
+}
+
+// MonthsLabel возвращает срок подписки прописью: "1 месяц", "3 месяца", "12 месяцев".
+func MonthsLabel(months int) string {
+	switch {
+	case months%10 == 1 && months%100 != 11:
+		return fmt.Sprintf("%d месяц", months)
+	case months%10 >= 2 && months%10 <= 4 && (months%100 < 12 || months%100 > 14):
+		return fmt.Sprintf("%d месяца", months)
+	default:
+		return fmt.Sprintf("%d месяцев", months)
+	}
+}
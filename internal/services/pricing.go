@@ -0,0 +1,83 @@
+package services
+
+import (
+	"math"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// Quote – расчёт стоимости тарифного плана для конкретного пользователя.
+type Quote struct {
+	Plan            db.Plan
+	BasePrice       float64       // Цена плана без персональных скидок
+	DiscountPercent int           // Применённая персональная скидка в процентах
+	PromoCode       *db.PromoCode // Применённый промокод; nil, если промокод не действует
+	PromoDiscount   float64       // Сумма скидки по промокоду
+	FinalPrice      float64       // Итоговая сумма к оплате
+}
+
+// minPaymentAmount – минимальная сумма платежа, которую принимает Юкасса.
+const minPaymentAmount = 1.0
+
+// HasDiscount сообщает, отличается ли итоговая цена от цены плана.
+func (q Quote) HasDiscount() bool {
+	return q.FinalPrice < q.BasePrice
+}
+
+// ActiveDiscount возвращает действующую персональную скидку пользователя в процентах.
+func ActiveDiscount(user *db.User) int {
+	if user.CurrentDiscount <= 0 {
+		return 0
+	}
+	if user.DiscountUntil != nil && user.DiscountUntil.Before(time.Now()) {
+		return 0
+	}
+	if user.CurrentDiscount > 100 {
+		return 100
+	}
+	return user.CurrentDiscount
+}
+
+// QuotePlan рассчитывает стоимость плана на сервере для пользователя: сначала применяется
+// персональная скидка, затем промокод, если он действует для этого сервера и плана.
+// Ненулевая итоговая цена не бывает меньше minPaymentAmount.
+func QuotePlan(user *db.User, serverID int, plan db.Plan, promo *db.PromoCode) Quote {
+	quote := Quote{
+		Plan:            plan,
+		BasePrice:       plan.Price,
+		DiscountPercent: ActiveDiscount(user),
+	}
+	price := roundPrice(plan.Price * float64(100-quote.DiscountPercent) / 100)
+
+	if promo != nil && PromoApplies(promo, serverID, plan.ID) {
+		var discount float64
+		if promo.Percent > 0 {
+			discount = roundPrice(price * float64(promo.Percent) / 100)
+		} else {
+			discount = promo.Amount
+		}
+		if price-discount < minPaymentAmount {
+			discount = price - minPaymentAmount
+		}
+		if discount > 0 {
+			quote.PromoCode = promo
+			quote.PromoDiscount = roundPrice(discount)
+			price = roundPrice(price - discount)
+		}
+	}
+
+	// Юкасса не примет платеж меньше минимальной суммы – поднимаем цену до неё. Нулевая цена
+	// (скидка 100%) остаётся: такой заказ оформляется без платежа в Юкассе.
+	if price > 0 && price < minPaymentAmount {
+		price = minPaymentAmount
+	}
+
+	quote.FinalPrice = price
+	return quote
+}
+
+// roundPrice округляет сумму до копеек.
+func roundPrice(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
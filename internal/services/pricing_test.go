@@ -0,0 +1,68 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+func TestQuotePlan(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	plan := db.Plan{ID: 3, Months: 3, Price: 1000}
+
+	tests := []struct {
+		name      string
+		user      db.User
+		promo     *db.PromoCode
+		wantPrice float64
+		wantPromo float64
+	}{
+		{"без скидок", db.User{}, nil, 1000, 0},
+		{"персональная скидка", db.User{CurrentDiscount: 10}, nil, 900, 0},
+		{"персональная скидка до даты", db.User{CurrentDiscount: 10, DiscountUntil: &future}, nil, 900, 0},
+		{"истёкшая персональная скидка", db.User{CurrentDiscount: 10, DiscountUntil: &past}, nil, 1000, 0},
+		{"процентный промокод после персональной скидки", db.User{CurrentDiscount: 10}, &db.PromoCode{ID: 1, Percent: 20}, 720, 180},
+		{"фиксированный промокод", db.User{}, &db.PromoCode{ID: 1, Amount: 150}, 850, 150},
+		{"промокод не опускает цену ниже минимального платежа", db.User{}, &db.PromoCode{ID: 1, Amount: 5000}, minPaymentAmount, 1000 - minPaymentAmount},
+		{"промокод для другого сервера", db.User{}, &db.PromoCode{ID: 1, Percent: 20, AllowedServers: "2"}, 1000, 0},
+		{"промокод для этого плана", db.User{}, &db.PromoCode{ID: 1, Percent: 20, AllowedPlans: "1, 3"}, 800, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote := QuotePlan(&tt.user, 1, plan, tt.promo)
+			if quote.FinalPrice != tt.wantPrice {
+				t.Errorf("FinalPrice = %.2f, ожидалось %.2f", quote.FinalPrice, tt.wantPrice)
+			}
+			if quote.PromoDiscount != tt.wantPromo {
+				t.Errorf("PromoDiscount = %.2f, ожидалось %.2f", quote.PromoDiscount, tt.wantPromo)
+			}
+			if (quote.PromoCode != nil) != (tt.wantPromo > 0) {
+				t.Errorf("PromoCode = %v, ожидалось применение промокода: %v", quote.PromoCode, tt.wantPromo > 0)
+			}
+		})
+	}
+}
+
+func TestQuotePlanMinPayment(t *testing.T) {
+	plan := db.Plan{ID: 1, Months: 1, Price: 50}
+
+	tests := []struct {
+		name      string
+		discount  int
+		wantPrice float64
+	}{
+		{"персональная скидка не опускает цену ниже минимального платежа", 99, minPaymentAmount},
+		{"полная персональная скидка", 100, 0},
+		{"цена выше минимального платежа", 90, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote := QuotePlan(&db.User{CurrentDiscount: tt.discount}, 1, plan, nil)
+			if quote.FinalPrice != tt.wantPrice {
+				t.Errorf("FinalPrice = %.2f, ожидалось %.2f", quote.FinalPrice, tt.wantPrice)
+			}
+		})
+	}
+}
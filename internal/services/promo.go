@@ -0,0 +1,148 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Ошибки проверки промокода. Их текст показывается пользователю.
+var (
+	ErrPromoNotFound   = errors.New("промокод не найден")
+	ErrPromoExpired    = errors.New("срок действия промокода истёк или ещё не начался")
+	ErrPromoExhausted  = errors.New("промокод больше недоступен: лимит использований исчерпан")
+	ErrPromoUserLimit  = errors.New("вы уже использовали этот промокод")
+	ErrPromoNotAllowed = errors.New("промокод не действует для выбранного сервера или тарифа")
+	ErrPromoInactive   = errors.New("промокод больше не действует")
+)
+
+// NormalizePromoCode приводит введённый промокод к виду, в котором он хранится в БД.
+func NormalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// FindPromoCode находит промокод и проверяет, что пользователь может его применить:
+// промокод активен, действует по датам и не исчерпал общий и персональный лимиты.
+func FindPromoCode(user *db.User, code string) (*db.PromoCode, error) {
+	var promo db.PromoCode
+	err := db.DB.Where("code = ? AND is_active = ?", NormalizePromoCode(code), true).First(&promo).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPromoNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("ошибка поиска промокода: %v", err)
+	}
+
+	if err := checkPromoValidity(&promo, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := checkPromoLimits(db.DB, &promo, user.ID); err != nil {
+		return nil, err
+	}
+	return &promo, nil
+}
+
+// checkPromoValidity проверяет, что промокод включен и действует по датам на момент now.
+func checkPromoValidity(promo *db.PromoCode, now time.Time) error {
+	if !promo.IsActive {
+		return ErrPromoInactive
+	}
+	if (promo.ValidFrom != nil && now.Before(*promo.ValidFrom)) || (promo.ValidTo != nil && now.After(*promo.ValidTo)) {
+		return ErrPromoExpired
+	}
+	return nil
+}
+
+// checkPromoLimits проверяет, что промокод не исчерпал общий лимит и лимит пользователя userID.
+func checkPromoLimits(conn *gorm.DB, promo *db.PromoCode, userID int) error {
+	if promo.MaxUses > 0 {
+		used, err := countRedemptions(conn, "promo_redemptions.promo_code_id = ?", promo.ID)
+		if err != nil {
+			return err
+		}
+		if used >= int64(promo.MaxUses) {
+			return ErrPromoExhausted
+		}
+	}
+
+	if promo.PerUserLimit > 0 {
+		used, err := countRedemptions(conn, "promo_redemptions.promo_code_id = ? AND promo_redemptions.user_id = ?", promo.ID, userID)
+		if err != nil {
+			return err
+		}
+		if used >= int64(promo.PerUserLimit) {
+			return ErrPromoUserLimit
+		}
+	}
+	return nil
+}
+
+// countRedemptions считает применения промокода, не учитывая отменённые платежи.
+func countRedemptions(conn *gorm.DB, query string, args ...interface{}) (int64, error) {
+	var count int64
+	err := conn.Model(&db.PromoRedemption{}).
+		Joins("JOIN payments ON payments.id = promo_redemptions.payment_id").
+		Where(query, args...).
+		Where("payments.status <> ?", db.PaymentCanceled).
+		Count(&count).Error
+	if err != nil {
+		return 0, fmt.Errorf("ошибка подсчёта использований промокода: %v", err)
+	}
+	return count, nil
+}
+
+// PromoApplies проверяет, действует ли промокод для сервера и тарифного плана.
+func PromoApplies(promo *db.PromoCode, serverID, planID int) bool {
+	return idListAllows(promo.AllowedServers, serverID) && idListAllows(promo.AllowedPlans, planID)
+}
+
+// idListAllows проверяет, входит ли id в список ID через запятую. Пустой список разрешает любой id.
+func idListAllows(list string, id int) bool {
+	if strings.TrimSpace(list) == "" {
+		return true
+	}
+	for _, part := range strings.Split(list, ",") {
+		if allowed, err := strconv.Atoi(strings.TrimSpace(part)); err == nil && allowed == id {
+			return true
+		}
+	}
+	return false
+}
+
+// redeemPromoCode фиксирует применение промокода в платеже в транзакции tx. Строка промокода
+// блокируется, а срок действия и лимиты использований проверяются повторно: между проверкой
+// в FindPromoCode и оплатой администратор мог отключить промокод, срок мог истечь, а
+// параллельные покупки – исчерпать лимиты.
+func redeemPromoCode(tx *gorm.DB, quote Quote, userID, paymentID int) error {
+	if quote.PromoCode == nil {
+		return nil
+	}
+
+	var promo db.PromoCode
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&promo, quote.PromoCode.ID).Error; err != nil {
+		return fmt.Errorf("промокод %s не найден: %v", quote.PromoCode.Code, err)
+	}
+	if err := checkPromoValidity(&promo, time.Now()); err != nil {
+		return err
+	}
+	if err := checkPromoLimits(tx, &promo, userID); err != nil {
+		return err
+	}
+
+	redemption := db.PromoRedemption{
+		PromoCodeID: promo.ID,
+		UserID:      userID,
+		PaymentID:   paymentID,
+		Discount:    quote.PromoDiscount,
+	}
+	if err := tx.Create(&redemption).Error; err != nil {
+		return fmt.Errorf("ошибка записи применения промокода %s: %v", promo.Code, err)
+	}
+	return nil
+}
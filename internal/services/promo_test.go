@@ -0,0 +1,59 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+func TestCheckPromoValidity(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		promo db.PromoCode
+		want  error
+	}{
+		{"действующий", db.PromoCode{IsActive: true}, nil},
+		{"в пределах дат", db.PromoCode{IsActive: true, ValidFrom: &past, ValidTo: &future}, nil},
+		{"отключён", db.PromoCode{}, ErrPromoInactive},
+		{"истёк", db.PromoCode{IsActive: true, ValidTo: &past}, ErrPromoExpired},
+		{"ещё не начался", db.PromoCode{IsActive: true, ValidFrom: &future}, ErrPromoExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkPromoValidity(&tt.promo, now); !errors.Is(err, tt.want) {
+				t.Errorf("checkPromoValidity() = %v, ожидалось %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestCreateBalancePaymentRejectsDeactivatedPromo проверяет, что промокод, отключённый после
+// расчёта цены, не применяется при оплате, а платеж не создаётся.
+func TestCreateBalancePaymentRejectsDeactivatedPromo(t *testing.T) {
+	requireTestDB(t)
+	user := createTestUser(t, 100)
+	promo := db.PromoCode{Code: fmt.Sprintf("TEST%d", testUnique()), Percent: 10}
+	if err := db.DB.Create(&promo).Error; err != nil {
+		t.Fatalf("ошибка создания промокода: %v", err)
+	}
+	t.Cleanup(func() { db.DB.Delete(&promo) })
+	quote := Quote{PromoCode: &promo, PromoDiscount: 10, FinalPrice: 90}
+
+	// Администратор отключает промокод между расчётом цены и оплатой.
+	db.DB.Model(&promo).Update("is_active", false)
+
+	payment := db.Payment{UserID: user.ID, YooKassaID: BalancePaymentID(user.ID), Kind: db.PaymentKindSubscription, BalanceAmount: 90}
+	if err := CreateBalancePayment(&payment, quote); !errors.Is(err, ErrPromoInactive) {
+		t.Fatalf("CreateBalancePayment() = %v, ожидалась ErrPromoInactive", err)
+	}
+	if balance := reloadUser(t, user).Balance; balance != 100 {
+		t.Errorf("баланс %.2f, ожидалось 100.00: платеж не должен был списать средства", balance)
+	}
+}
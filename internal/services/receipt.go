@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"vpn-bot/internal/db"
+)
+
+// Значения по умолчанию для чека 54-ФЗ.
+const (
+	defaultVATCode        = 1              // 1 – без НДС
+	defaultPaymentSubject = "service"      // Признак предмета расчёта: услуга
+	defaultPaymentMode    = "full_payment" // Признак способа расчёта: полный расчёт
+)
+
+// Статусы регистрации чека в Юкассе (поле receipt_registration платежа).
+const (
+	ReceiptPending   = "pending"
+	ReceiptSucceeded = "succeeded"
+	ReceiptCanceled  = "canceled"
+)
+
+// maxReceiptDescription – ограничение Юкассы на длину названия товара в чеке.
+const maxReceiptDescription = 128
+
+// ErrReceiptContactRequired возвращается, если для чека не указан ни email, ни телефон пользователя.
+var ErrReceiptContactRequired = errors.New("не указан email или телефон для отправки чека")
+
+// ErrInvalidReceiptContact возвращается, если введённый контакт не похож ни на email, ни на телефон.
+var ErrInvalidReceiptContact = errors.New("некорректный email или номер телефона")
+
+// YooKassaReceipt структура чека 54-ФЗ в запросе к Юкассе
+type YooKassaReceipt struct {
+	Customer YooKassaCustomer      `json:"customer"`
+	Items    []YooKassaReceiptItem `json:"items"`
+}
+
+// YooKassaCustomer структура контактов покупателя, на которые отправляется чек
+type YooKassaCustomer struct {
+	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty"`
+}
+
+// YooKassaReceiptItem структура позиции чека
+type YooKassaReceiptItem struct {
+	Description    string         `json:"description"`
+	Quantity       string         `json:"quantity"`
+	Amount         YooKassaAmount `json:"amount"`
+	VATCode        int            `json:"vat_code"`
+	PaymentSubject string         `json:"payment_subject"`
+	PaymentMode    string         `json:"payment_mode"`
+}
+
+var (
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phoneDigits  = regexp.MustCompile(`\D`)
+)
+
+// vatCode возвращает код ставки НДС из YOOKASSA_VAT_CODE.
+func vatCode() int {
+	value := os.Getenv("YOOKASSA_VAT_CODE")
+	if value == "" {
+		return defaultVATCode
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 1 || code > 6 {
+		log.Printf("🔴 Некорректное значение YOOKASSA_VAT_CODE: %q", value)
+		return defaultVATCode
+	}
+	return code
+}
+
+// paymentSubject возвращает признак предмета расчёта из YOOKASSA_PAYMENT_SUBJECT.
+func paymentSubject() string {
+	if value := os.Getenv("YOOKASSA_PAYMENT_SUBJECT"); value != "" {
+		return value
+	}
+	return defaultPaymentSubject
+}
+
+// paymentMode возвращает признак способа расчёта из YOOKASSA_PAYMENT_MODE.
+func paymentMode() string {
+	if value := os.Getenv("YOOKASSA_PAYMENT_MODE"); value != "" {
+		return value
+	}
+	return defaultPaymentMode
+}
+
+// HasReceiptContact сообщает, указан ли у пользователя контакт для отправки чека.
+func HasReceiptContact(user *db.User) bool {
+	return user.Email != "" || user.Phone != ""
+}
+
+// SetReceiptContact разбирает введённый пользователем email или телефон и сохраняет его.
+func SetReceiptContact(user *db.User, text string) error {
+	email, phone, err := parseReceiptContact(text)
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]interface{}{"email": email, "phone": phone}
+	if err := db.DB.Model(user).Updates(updates).Error; err != nil {
+		return fmt.Errorf("ошибка сохранения контакта для чека: %v", err)
+	}
+	user.Email = email
+	user.Phone = phone
+	return nil
+}
+
+// parseReceiptContact распознаёт в тексте email или телефон. Телефон приводится к формату
+// 7XXXXXXXXXX, который ожидает Юкасса.
+func parseReceiptContact(text string) (email, phone string, err error) {
+	text = strings.TrimSpace(text)
+	if emailPattern.MatchString(text) {
+		return strings.ToLower(text), "", nil
+	}
+
+	digits := phoneDigits.ReplaceAllString(text, "")
+	if len(digits) == 11 && digits[0] == '8' {
+		digits = "7" + digits[1:]
+	}
+	if len(digits) != 11 || digits[0] != '7' {
+		return "", "", ErrInvalidReceiptContact
+	}
+	return "", digits, nil
+}
+
+// ReceiptContact возвращает контакт пользователя для чеков в читаемом виде.
+func ReceiptContact(user *db.User) string {
+	if user.Email != "" {
+		return user.Email
+	}
+	if user.Phone != "" {
+		return "+" + user.Phone
+	}
+	return "не указан"
+}
+
+// PaymentReceipt формирует чек на сумму amount по платежу: позиция строится из назначения
+// платежа, сервера и срока подписки.
+func PaymentReceipt(user *db.User, payment db.Payment, amount float64) (*YooKassaReceipt, error) {
+	if !HasReceiptContact(user) {
+		return nil, ErrReceiptContactRequired
+	}
+
+	item := YooKassaReceiptItem{
+		Quantity:       "1.00",
+		Amount:         yooKassaAmount(amount),
+		VATCode:        vatCode(),
+		PaymentSubject: paymentSubject(),
+		PaymentMode:    paymentMode(),
+	}
+	if payment.Kind == db.PaymentKindTopUp {
+		// Пополнение баланса – аванс за будущие услуги.
+		item.Description = "Пополнение баланса VPN-сервиса"
+		item.PaymentSubject = "payment"
+		item.PaymentMode = "advance"
+	} else {
+		var server db.Server
+		if err := db.DB.Select("id", "name").First(&server, payment.ServerID).Error; err != nil {
+			return nil, fmt.Errorf("сервер %d не найден: %v", payment.ServerID, err)
+		}
+		item.Description = fmt.Sprintf("Доступ к VPN (%s) на %s", server.Name, MonthsLabel(payment.Months))
+	}
+	if runes := []rune(item.Description); len(runes) > maxReceiptDescription {
+		item.Description = string(runes[:maxReceiptDescription])
+	}
+
+	return &YooKassaReceipt{
+		Customer: YooKassaCustomer{Email: user.Email, Phone: user.Phone},
+		Items:    []YooKassaReceiptItem{item},
+	}, nil
+}
+
+// UpdateReceiptStatus сохраняет статус регистрации чека платежа, если он изменился.
+func UpdateReceiptStatus(payment *db.Payment, status string) {
+	if status == "" || status == payment.ReceiptStatus {
+		return
+	}
+	if err := db.DB.Model(payment).Update("receipt_status", status).Error; err != nil {
+		log.Printf("🔴 Ошибка обновления статуса чека платежа %s: %v", payment.YooKassaID, err)
+		return
+	}
+	if status == ReceiptCanceled {
+		log.Printf("🔴 Юкасса не смогла зарегистрировать чек по платежу %s", payment.YooKassaID)
+	}
+}
+
+// CheckPendingReceipts запрашивает статус регистрации чеков по успешным платежам,
+// для которых чек ещё не зарегистрирован.
+func CheckPendingReceipts() {
+	var payments []db.Payment
+	if err := db.DB.Where("status = ? AND receipt_status = ?", db.PaymentSucceeded, ReceiptPending).Find(&payments).Error; err != nil {
+		log.Printf("🔴 Ошибка выборки платежей с незарегистрированным чеком: %v", err)
+		return
+	}
+
+	for i := range payments {
+		paymentResp, err := GetYooKassaPayment(payments[i].YooKassaID)
+		if err != nil {
+			log.Printf("🔴 Ошибка проверки чека платежа %s: %v", payments[i].YooKassaID, err)
+			continue
+		}
+		UpdateReceiptStatus(&payments[i], paymentResp.ReceiptRegistration)
+	}
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseReceiptContact(t *testing.T) {
+	tests := []struct {
+		text      string
+		wantEmail string
+		wantPhone string
+		wantErr   error
+	}{
+		{"  User@Example.COM ", "user@example.com", "", nil},
+		{"+7 (912) 345-67-89", "", "79123456789", nil},
+		{"89123456789", "", "79123456789", nil},
+		{"79123456789", "", "79123456789", nil},
+		{"9123456789", "", "", ErrInvalidReceiptContact},
+		{"+1 555 123 4567", "", "", ErrInvalidReceiptContact},
+		{"user@example", "", "", ErrInvalidReceiptContact},
+		{"", "", "", ErrInvalidReceiptContact},
+	}
+	for _, tt := range tests {
+		email, phone, err := parseReceiptContact(tt.text)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("parseReceiptContact(%q): ошибка %v, ожидалась %v", tt.text, err, tt.wantErr)
+			continue
+		}
+		if email != tt.wantEmail || phone != tt.wantPhone {
+			t.Errorf("parseReceiptContact(%q) = (%q, %q), ожидалось (%q, %q)", tt.text, email, phone, tt.wantEmail, tt.wantPhone)
+		}
+	}
+}
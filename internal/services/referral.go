@@ -0,0 +1,258 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// referralCodePrefix – префикс параметра /start для реферальных ссылок.
+const referralCodePrefix = "ref_"
+
+// defaultReferralBonusDays – бонусные дни пригласившему, если REFERRAL_BONUS_DAYS не задан.
+const defaultReferralBonusDays = 7
+
+// ReferralStats – статистика приглашений пользователя.
+type ReferralStats struct {
+	Invited     int64   // Сколько пользователей перешло по ссылке
+	Rewarded    int64   // Сколько из них оплатили подписку
+	BonusDays   int64   // Сколько бонусных дней начислено
+	BonusAmount float64 // Сколько начислено на баланс
+}
+
+// referralBonusDays возвращает количество бонусных дней за приглашённого из REFERRAL_BONUS_DAYS.
+func referralBonusDays() int {
+	value := os.Getenv("REFERRAL_BONUS_DAYS")
+	if value == "" {
+		return defaultReferralBonusDays
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		log.Printf("🔴 Некорректное значение REFERRAL_BONUS_DAYS: %q", value)
+		return defaultReferralBonusDays
+	}
+	return days
+}
+
+// referralBonusAmount возвращает сумму, зачисляемую на баланс за приглашённого, из REFERRAL_BONUS_AMOUNT.
+// По умолчанию бонус на баланс не начисляется.
+func referralBonusAmount() float64 {
+	value := os.Getenv("REFERRAL_BONUS_AMOUNT")
+	if value == "" {
+		return 0
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil || amount < 0 {
+		log.Printf("🔴 Некорректное значение REFERRAL_BONUS_AMOUNT: %q", value)
+		return 0
+	}
+	return amount
+}
+
+// ReferralCode возвращает реферальный код пользователя.
+func ReferralCode(user *db.User) string {
+	return strconv.FormatInt(int64(user.ID), 36)
+}
+
+// ReferralLink возвращает ссылку-приглашение в бота botUserName.
+func ReferralLink(botUserName string, user *db.User) string {
+	return fmt.Sprintf("https://t.me/%s?start=%s%s", botUserName, referralCodePrefix, ReferralCode(user))
+}
+
+// RegisterReferral привязывает пользователя к пригласившему по параметру /start вида ref_<код>.
+// Привязка возможна только один раз и только до первой оплаты. Возвращает true, если привязка создана.
+func RegisterReferral(invitee *db.User, startParam string) (bool, error) {
+	if !strings.HasPrefix(startParam, referralCodePrefix) {
+		return false, nil
+	}
+	inviterID, err := strconv.ParseInt(strings.TrimPrefix(startParam, referralCodePrefix), 36, 64)
+	if err != nil || int(inviterID) == invitee.ID {
+		return false, nil
+	}
+
+	var inviter db.User
+	if err := db.DB.First(&inviter, inviterID).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("ошибка поиска пригласившего %d: %v", inviterID, err)
+	}
+
+	var paid int64
+	if err := db.DB.Model(&db.Payment{}).
+		Where("user_id = ? AND status = ?", invitee.ID, db.PaymentSucceeded).
+		Count(&paid).Error; err != nil {
+		return false, fmt.Errorf("ошибка проверки платежей пользователя %d: %v", invitee.ID, err)
+	}
+	if paid > 0 {
+		return false, nil
+	}
+
+	referral := db.Referral{InviterID: inviter.ID, InviteeID: invitee.ID}
+	result := db.DB.Where("invitee_id = ?", invitee.ID).FirstOrCreate(&referral)
+	if result.Error != nil {
+		return false, fmt.Errorf("ошибка сохранения приглашения: %v", result.Error)
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// creditReferral начисляет в транзакции tx пригласившему бонус за первый успешный платеж
+// приглашённого за подписку. Бонусные дни продлевают действующую платную подписку пригласившего,
+// а при её отсутствии копятся в User.BonusDays: пробная подписка не продлевается. Денежный бонус
+// зачисляется на баланс. Возвращает вознаграждённое приглашение или nil, если бонус не положен.
+func creditReferral(tx *gorm.DB, payment db.Payment) (*db.Referral, error) {
+	if payment.Kind == db.PaymentKindTopUp {
+		return nil, nil
+	}
+	days := referralBonusDays()
+	amount := referralBonusAmount()
+	if days == 0 && amount == 0 {
+		return nil, nil
+	}
+
+	// Блокировка строки приглашения защищает от повторного начисления.
+	var referral db.Referral
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("invitee_id = ? AND rewarded_at IS NULL", payment.UserID).
+		First(&referral).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("ошибка поиска приглашения пользователя %d: %v", payment.UserID, err)
+	}
+
+	now := time.Now()
+	if err := tx.Model(&referral).Updates(map[string]interface{}{
+		"reward_payment_id": payment.ID,
+		"bonus_days":        days,
+		"bonus_amount":      amount,
+		"rewarded_at":       now,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("ошибка начисления реферального бонуса: %v", err)
+	}
+	referral.RewardPaymentID = &payment.ID
+	referral.BonusDays = days
+	referral.BonusAmount = amount
+	referral.RewardedAt = &now
+
+	if err := transferBalance(tx, referral.InviterID, amount, BalanceReferral, &payment.ID, "Бонус за приглашённого"); err != nil {
+		return nil, fmt.Errorf("ошибка начисления реферального бонуса: %v", err)
+	}
+	if days == 0 {
+		return &referral, nil
+	}
+
+	var subscription db.Subscription
+	err = tx.Where("user_id = ? AND status = ? AND is_trial = ?", referral.InviterID, db.SubscriptionActive, false).
+		Order("expires_at DESC").
+		First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = tx.Model(&db.User{}).Where("id = ?", referral.InviterID).
+			Update("bonus_days", gorm.Expr("bonus_days + ?", days)).Error
+	} else if err == nil {
+		referral.BonusSubscriptionID = &subscription.ID
+		err = tx.Model(&subscription).
+			Update("expires_at", subscription.ExpiresAt.AddDate(0, 0, days)).Error
+	}
+	if err == nil {
+		err = tx.Model(&referral).Update("bonus_subscription_id", referral.BonusSubscriptionID).Error
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка начисления бонусных дней: %v", err)
+	}
+	return &referral, nil
+}
+
+// reverseReferral отменяет в транзакции tx бонус, начисленный пригласившему за полностью
+// возвращённый платеж: с баланса списывается начисленная сумма (но не больше остатка), а
+// бонусные дни снимаются с продлённой подписки или с накопленных User.BonusDays. Возвращает
+// приглашение с отменённым бонусом или nil, если за платеж бонус не начислялся.
+func reverseReferral(tx *gorm.DB, payment db.Payment) (*db.Referral, error) {
+	var referral db.Referral
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("reward_payment_id = ? AND reversed_at IS NULL", payment.ID).
+		First(&referral).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("ошибка поиска приглашения по платежу %d: %v", payment.ID, err)
+	}
+
+	now := time.Now()
+	if err := tx.Model(&referral).Update("reversed_at", now).Error; err != nil {
+		return nil, fmt.Errorf("ошибка отмены реферального бонуса: %v", err)
+	}
+	referral.ReversedAt = &now
+
+	if referral.BonusAmount > 0 {
+		// Бонус мог быть уже потрачен – списываем не больше остатка, не уводя баланс в минус.
+		var inviter db.User
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "balance").First(&inviter, referral.InviterID).Error; err != nil {
+			return nil, fmt.Errorf("пригласивший %d не найден: %v", referral.InviterID, err)
+		}
+		amount := math.Min(referral.BonusAmount, inviter.Balance)
+		if err := transferBalance(tx, referral.InviterID, -amount, BalanceReferral, &payment.ID, "Отмена бонуса за приглашённого"); err != nil {
+			return nil, fmt.Errorf("ошибка отмены реферального бонуса: %v", err)
+		}
+	}
+
+	if referral.BonusDays > 0 {
+		var err error
+		if referral.BonusSubscriptionID != nil {
+			// Срок сокращается без отзыва: если он истёк, подписку переведёт в expired
+			// ExpireSubscriptions, а продлить её можно будет как обычно.
+			err = tx.Model(&db.Subscription{}).
+				Where("id = ? AND status = ?", *referral.BonusSubscriptionID, db.SubscriptionActive).
+				Update("expires_at", gorm.Expr("expires_at - make_interval(days => ?)", referral.BonusDays)).Error
+		} else {
+			err = tx.Model(&db.User{}).Where("id = ?", referral.InviterID).
+				Update("bonus_days", gorm.Expr("GREATEST(bonus_days - ?, 0)", referral.BonusDays)).Error
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ошибка отмены бонусных дней: %v", err)
+		}
+	}
+	return &referral, nil
+}
+
+// notifyReferralReversed сообщает пригласившему об отмене бонуса.
+func notifyReferralReversed(referral db.Referral) {
+	NotifyUser(referral.InviterID, "⚠️ Оплата приглашённого вами друга возвращена – начисленный за неё реферальный бонус отменён.")
+}
+
+// notifyReferralReward сообщает пригласившему о начисленном бонусе.
+func notifyReferralReward(referral db.Referral) {
+	message := "🎉 Приглашённый вами друг оформил подписку!"
+	if referral.BonusDays > 0 {
+		message += fmt.Sprintf(" Вам начислено бонусных дней: %d.", referral.BonusDays)
+	}
+	if referral.BonusAmount > 0 {
+		message += fmt.Sprintf(" На баланс зачислено %.2f₽.", referral.BonusAmount)
+	}
+	NotifyUser(referral.InviterID, message)
+}
+
+// GetReferralStats возвращает статистику приглашений пользователя.
+func GetReferralStats(user *db.User) (ReferralStats, error) {
+	var stats ReferralStats
+	err := db.DB.Model(&db.Referral{}).
+		Select(`COUNT(*) AS invited,
+			COUNT(CASE WHEN reversed_at IS NULL THEN rewarded_at END) AS rewarded,
+			COALESCE(SUM(CASE WHEN reversed_at IS NULL THEN bonus_days END), 0) AS bonus_days,
+			COALESCE(SUM(CASE WHEN reversed_at IS NULL THEN bonus_amount END), 0) AS bonus_amount`).
+		Where("inviter_id = ?", user.ID).
+		Scan(&stats).Error
+	if err != nil {
+		return stats, fmt.Errorf("ошибка получения статистики приглашений: %v", err)
+	}
+	return stats, nil
+}
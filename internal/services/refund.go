@@ -0,0 +1,450 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// YooKassaRefundRequest структура запроса на создание возврата в Юкассе
+type YooKassaRefundRequest struct {
+	PaymentID   string           `json:"payment_id"`
+	Amount      YooKassaAmount   `json:"amount"`
+	Description string           `json:"description,omitempty"`
+	Receipt     *YooKassaReceipt `json:"receipt,omitempty"` // Чек возврата 54-ФЗ
+}
+
+// YooKassaRefundResponse структура ответа Юкассы по возврату
+type YooKassaRefundResponse struct {
+	ID                  string                       `json:"id"`
+	Status              string                       `json:"status"`
+	PaymentID           string                       `json:"payment_id"`
+	Amount              YooKassaAmount               `json:"amount"`
+	CancellationDetails *YooKassaCancellationDetails `json:"cancellation_details,omitempty"`
+}
+
+// Ошибки оформления возврата.
+var (
+	ErrRefundNotAllowed = errors.New("возврат возможен только по успешному платежу")
+	ErrRefundTooLarge   = errors.New("сумма возврата превышает оплаченную сумму")
+	ErrNothingToRefund  = errors.New("по платежу уже всё возвращено")
+)
+
+// errRefundProcessed означает, что возврат уже был обработан ранее.
+var errRefundProcessed = errors.New("возврат уже обработан")
+
+// Повторная отправка возвратов, не дошедших до Юкассы: не раньше refundResubmitDelay после
+// создания (чтобы не пересечься с первой отправкой) и не позже refundResubmitWindow – столько
+// Юкасса хранит ключ идемпотентности. Более старые возвраты нужно проверить в личном кабинете.
+const (
+	refundResubmitDelay  = time.Minute
+	refundResubmitWindow = 24 * time.Hour
+)
+
+// CreateYooKassaRefund создаёт в Юкассе возврат суммы amount по платежу yooKassaPaymentID
+// с чеком возврата receipt. Ключ идемпотентности строится из ID возврата в БД refundID:
+// повторная отправка того же возврата не создаст в Юкассе второй.
+func CreateYooKassaRefund(refundID int, yooKassaPaymentID string, amount float64, description string, receipt *YooKassaReceipt) (*YooKassaRefundResponse, error) {
+	requestBody := YooKassaRefundRequest{
+		PaymentID:   yooKassaPaymentID,
+		Amount:      yooKassaAmount(amount),
+		Description: description,
+		Receipt:     receipt,
+	}
+
+	var refundResp YooKassaRefundResponse
+	idempotenceKey := fmt.Sprintf("refund-%d", refundID)
+	if err := postYooKassa("/refunds", idempotenceKey, requestBody, &refundResp); err != nil {
+		return nil, err
+	}
+	if refundResp.ID == "" {
+		return nil, fmt.Errorf("невалидный ответ Юкассы")
+	}
+	return &refundResp, nil
+}
+
+// GetYooKassaRefund запрашивает у Юкассы актуальные данные возврата по его ID.
+func GetYooKassaRefund(refundID string) (*YooKassaRefundResponse, error) {
+	var refundResp YooKassaRefundResponse
+	if err := getYooKassa("/refunds/"+refundID, &refundResp); err != nil {
+		return nil, err
+	}
+	return &refundResp, nil
+}
+
+// RefundPayment оформляет возврат по успешному платежу. amount <= 0 означает полный возврат:
+// на карту возвращается весь остаток, а на баланс – часть, оплаченная с баланса.
+// Частичный возврат проводится только на карту.
+//
+// Возврат сначала записывается в БД, а затем отправляется в Юкассу с ключом идемпотентности
+// из его ID: транзакция не удерживается во время запроса, а при сбое сети CheckPendingRefunds
+// повторит отправку, не создав второй возврат.
+func RefundPayment(payment *db.Payment, amount float64, reason string) (*db.Refund, error) {
+	var refund db.Refund
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// Блокируем платеж, чтобы параллельные возвраты не превысили оплаченную сумму.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(payment, payment.ID).Error; err != nil {
+			return fmt.Errorf("платеж %d не найден: %v", payment.ID, err)
+		}
+		if payment.Status != db.PaymentSucceeded {
+			return ErrRefundNotAllowed
+		}
+
+		refundable := roundPrice(payment.Amount - payment.RefundedAmount)
+		full := amount <= 0
+		if full {
+			amount = refundable
+		}
+		amount = roundPrice(amount)
+		if amount > refundable {
+			return ErrRefundTooLarge
+		}
+
+		var balanceAmount float64
+		if full {
+			returned, err := returnedBalance(tx, payment.ID)
+			if err != nil {
+				return err
+			}
+			balanceAmount = roundPrice(payment.BalanceAmount - returned)
+		}
+		if amount <= 0 && balanceAmount <= 0 {
+			return ErrNothingToRefund
+		}
+
+		// Пополнение возвращается за счёт баланса: списываем сумму сразу, чтобы пользователь
+		// не успел потратить средства, пока Юкасса обрабатывает возврат.
+		if payment.Kind == db.PaymentKindTopUp {
+			if err := transferBalance(tx, payment.UserID, -amount, BalanceRefund, &payment.ID, "Возврат пополнения"); err != nil {
+				return err
+			}
+		}
+
+		refund = db.Refund{
+			PaymentID:     payment.ID,
+			Amount:        amount,
+			BalanceAmount: balanceAmount,
+			Reason:        reason,
+			Status:        db.RefundPending,
+		}
+		if err := tx.Create(&refund).Error; err != nil {
+			return err
+		}
+		payment.RefundedAmount = roundPrice(payment.RefundedAmount + amount)
+		return tx.Model(payment).Update("refunded_amount", payment.RefundedAmount).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := submitRefund(&refund); err != nil {
+		if refund.Status == db.RefundCanceled {
+			return nil, fmt.Errorf("Юкасса отклонила возврат: %v", err)
+		}
+		// Возврат остаётся pending – CheckPendingRefunds отправит его повторно.
+		log.Printf("⚠️ Возврат %d не отправлен в Юкассу, будет повторён: %v", refund.ID, err)
+	}
+	return &refund, nil
+}
+
+// submitRefund отправляет в Юкассу записанный в БД возврат и применяет полученный статус.
+// Возврат только на баланс проводится сразу. Если Юкасса отклонила запрос и повтор его не
+// исправит, возврат отменяется; при временных ошибках он остаётся pending.
+func submitRefund(refund *db.Refund) error {
+	if refund.Amount <= 0 {
+		return completeRefund(refund)
+	}
+
+	var payment db.Payment
+	if err := db.DB.First(&payment, refund.PaymentID).Error; err != nil {
+		return fmt.Errorf("платеж %d не найден: %v", refund.PaymentID, err)
+	}
+	// Чек возврата нужен, только если чек передавался при оплате.
+	var receipt *YooKassaReceipt
+	if payment.ReceiptStatus != "" {
+		var user db.User
+		if err := db.DB.First(&user, payment.UserID).Error; err != nil {
+			return fmt.Errorf("пользователь %d не найден: %v", payment.UserID, err)
+		}
+		var err error
+		if receipt, err = PaymentReceipt(&user, payment, refund.Amount); err != nil {
+			return err
+		}
+	}
+
+	refundResp, err := CreateYooKassaRefund(refund.ID, payment.YooKassaID, refund.Amount, refund.Reason, receipt)
+	if err != nil {
+		var apiErr *YooKassaError
+		if errors.As(err, &apiErr) && !apiErr.Temporary() {
+			cancelRefund(refund)
+		}
+		return err
+	}
+
+	if err := db.DB.Model(refund).Update("yoo_kassa_id", refundResp.ID).Error; err != nil {
+		// Повторная отправка с тем же ключом идемпотентности вернёт этот же возврат.
+		return fmt.Errorf("возврат %s создан в Юкассе, но не записан в БД: %v", refundResp.ID, err)
+	}
+	// Незавершённые возвраты доведёт до конца CheckPendingRefunds.
+	switch refundResp.Status {
+	case db.RefundSucceeded:
+		return completeRefund(refund)
+	case db.RefundCanceled:
+		cancelRefund(refund)
+	}
+	return nil
+}
+
+// CheckPendingRefunds доводит до конца незавершённые возвраты: повторно отправляет возвраты,
+// не дошедшие до Юкассы, и запрашивает статус уже отправленных.
+func CheckPendingRefunds() {
+	now := time.Now()
+	var unsent []db.Refund
+	if err := db.DB.Where("status = ? AND yoo_kassa_id = '' AND created_at < ?", db.RefundPending, now.Add(-refundResubmitDelay)).
+		Where("amount <= 0 OR created_at > ?", now.Add(-refundResubmitWindow)).
+		Find(&unsent).Error; err != nil {
+		log.Printf("🔴 Ошибка выборки неотправленных возвратов: %v", err)
+		return
+	}
+	for i := range unsent {
+		if err := submitRefund(&unsent[i]); err != nil {
+			log.Printf("🔴 Ошибка повторной отправки возврата %d: %v", unsent[i].ID, err)
+		}
+	}
+
+	var refunds []db.Refund
+	if err := db.DB.Where("status = ? AND yoo_kassa_id <> ''", db.RefundPending).Find(&refunds).Error; err != nil {
+		log.Printf("🔴 Ошибка выборки незавершённых возвратов: %v", err)
+		return
+	}
+
+	for i := range refunds {
+		if err := syncRefund(&refunds[i]); err != nil {
+			log.Printf("🔴 Ошибка проверки статуса возврата %s: %v", refunds[i].YooKassaID, err)
+		}
+	}
+}
+
+// SyncRefund запрашивает у Юкассы статус возврата refundID и применяет результат.
+// Используется при получении уведомления refund.succeeded. Возвраты, созданные не через бота
+// (например, в личном кабинете Юкассы), пропускаются.
+func SyncRefund(refundID string) error {
+	var refund db.Refund
+	if err := db.DB.Where("yoo_kassa_id = ?", refundID).First(&refund).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("⚠️ Возврат %s не найден в БД – вероятно, создан вне бота", refundID)
+			return nil
+		}
+		return err
+	}
+	return syncRefund(&refund)
+}
+
+// syncRefund запрашивает у Юкассы статус возврата и проводит или отменяет его.
+func syncRefund(refund *db.Refund) error {
+	if refund.Status != db.RefundPending {
+		return nil
+	}
+	refundResp, err := GetYooKassaRefund(refund.YooKassaID)
+	if err != nil {
+		return err
+	}
+	switch refundResp.Status {
+	case db.RefundSucceeded:
+		return completeRefund(refund)
+	case db.RefundCanceled:
+		cancelRefund(refund)
+	}
+	return nil
+}
+
+// completeRefund отмечает возврат проведённым и в той же транзакции применяет его последствия:
+// возвращает часть платежа на баланс, переводит полностью возвращённый платеж в статус refunded
+// с отменой реферального бонуса за него и отзывает или сокращает подписку. При ошибке возврат
+// остаётся pending, и его проведение повторит CheckPendingRefunds. После фиксации пользователь
+// получает уведомление.
+func completeRefund(refund *db.Refund) error {
+	var payment db.Payment
+	var subscriptionText string
+	var reversed *db.Referral
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		// Условное обновление статуса гарантирует, что последствия применятся один раз.
+		result := tx.Model(refund).Where("status = ?", db.RefundPending).Update("status", db.RefundSucceeded)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefundProcessed
+		}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, refund.PaymentID).Error; err != nil {
+			return err
+		}
+		if err := transferBalance(tx, payment.UserID, refund.BalanceAmount, BalanceRefund, &payment.ID, "Возврат по платежу"); err != nil {
+			return err
+		}
+
+		// Полностью возвращённый платеж переводится в статус refunded, а начисленный за него
+		// реферальный бонус отменяется.
+		fullyRefunded, err := isFullyRefunded(tx, payment)
+		if err != nil {
+			return err
+		}
+		if fullyRefunded {
+			if _, err := transitionPayment(tx, &payment, db.PaymentRefunded, nil); err != nil {
+				return err
+			}
+			if reversed, err = reverseReferral(tx, payment); err != nil {
+				return err
+			}
+		}
+
+		subscriptionText, err = applyRefundToSubscription(tx, payment, *refund)
+		return err
+	})
+	if errors.Is(err, errRefundProcessed) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка проведения возврата %d: %v", refund.ID, err)
+	}
+	refund.Status = db.RefundSucceeded
+
+	text := fmt.Sprintf("💸 По вашему платежу оформлен возврат: %s.", refundAmountText(*refund))
+	if subscriptionText != "" {
+		text += "\n" + subscriptionText
+	}
+	NotifyUser(payment.UserID, text)
+	if reversed != nil {
+		notifyReferralReversed(*reversed)
+	}
+	return nil
+}
+
+// cancelRefund отмечает возврат отклонённым и снимает зарезервированные под него суммы.
+func cancelRefund(refund *db.Refund) {
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(refund).Where("status = ?", db.RefundPending).Update("status", db.RefundCanceled)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefundProcessed
+		}
+
+		var payment db.Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, refund.PaymentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&payment).
+			Update("refunded_amount", roundPrice(payment.RefundedAmount-refund.Amount)).Error; err != nil {
+			return err
+		}
+		if payment.Kind == db.PaymentKindTopUp {
+			return transferBalance(tx, payment.UserID, refund.Amount, BalanceRefund, &payment.ID, "Отмена возврата пополнения")
+		}
+		return nil
+	})
+	if errors.Is(err, errRefundProcessed) {
+		return
+	}
+	if err != nil {
+		log.Printf("🔴 Ошибка отмены возврата %d: %v", refund.ID, err)
+		return
+	}
+	refund.Status = db.RefundCanceled
+	log.Printf("⚠️ Юкасса отклонила возврат %s по платежу %d", refund.YooKassaID, refund.PaymentID)
+}
+
+// returnedBalance возвращает сумму, возвращённую (или возвращаемую) на баланс по платежу.
+func returnedBalance(tx *gorm.DB, paymentID int) (float64, error) {
+	var returned float64
+	err := tx.Model(&db.Refund{}).
+		Where("payment_id = ? AND status <> ?", paymentID, db.RefundCanceled).
+		Select("COALESCE(SUM(balance_amount), 0)").
+		Scan(&returned).Error
+	return returned, err
+}
+
+// isFullyRefunded сообщает, возвращена ли вся сумма платежа: и часть, оплаченная картой,
+// и часть, оплаченная с баланса.
+func isFullyRefunded(tx *gorm.DB, payment db.Payment) (bool, error) {
+	if roundPrice(payment.Amount-payment.RefundedAmount) > 0 {
+		return false, nil
+	}
+	returned, err := returnedBalance(tx, payment.ID)
+	if err != nil {
+		return false, fmt.Errorf("ошибка подсчёта возвратов по платежу %d: %v", payment.ID, err)
+	}
+	return roundPrice(payment.BalanceAmount-returned) <= 0, nil
+}
+
+// applyRefundToSubscription в транзакции tx отзывает или сокращает подписку, оплаченную
+// возвращённым платежом, и возвращает описание изменений для пользователя. Полный возврат
+// первичной покупки отзывает подписку и выводит ключ из оборота, в остальных случаях срок
+// сокращается пропорционально доле возвращённой суммы.
+func applyRefundToSubscription(tx *gorm.DB, payment db.Payment, refund db.Refund) (string, error) {
+	if payment.Kind == db.PaymentKindTopUp {
+		return "", nil
+	}
+
+	var subscription db.Subscription
+	query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("payment_id = ?", payment.ID)
+	if payment.SubscriptionID != nil {
+		query = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", *payment.SubscriptionID)
+	}
+	if err := query.First(&subscription).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		// Платежи, оплаченные до появления подписок, не связаны с подпиской.
+		log.Printf("⚠️ Подписка платежа %d не найдена – срок не изменён", payment.ID)
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("ошибка получения подписки платежа %d: %v", payment.ID, err)
+	}
+	if subscription.Status != db.SubscriptionActive {
+		return "", nil
+	}
+
+	fullyRefunded := roundPrice(payment.Amount-payment.RefundedAmount) <= 0
+	if payment.SubscriptionID == nil && fullyRefunded {
+		if err := revokeSubscription(tx, &subscription); err != nil {
+			return "", err
+		}
+		return "❌ Подписка отозвана.", nil
+	}
+
+	total := payment.Amount + payment.BalanceAmount
+	if total <= 0 {
+		return "", nil
+	}
+	months := payment.Months
+	if months <= 0 {
+		months = 1
+	}
+	share := (refund.Amount + refund.BalanceAmount) / total
+	period := subscriptionExpiresAt(subscription.ExpiresAt, months).Sub(subscription.ExpiresAt)
+	if err := shortenSubscription(tx, &subscription, time.Duration(share*float64(period))); err != nil {
+		return "", err
+	}
+	if subscription.Status == db.SubscriptionRevoked {
+		return "❌ Подписка отозвана.", nil
+	}
+	return fmt.Sprintf("📅 Срок подписки сокращён до %s.", subscription.ExpiresAt.Format("02.01.2006")), nil
+}
+
+// refundAmountText описывает, куда и сколько возвращено по возврату.
+func refundAmountText(refund db.Refund) string {
+	var parts []string
+	if refund.Amount > 0 {
+		parts = append(parts, fmt.Sprintf("%.2f₽ на карту", refund.Amount))
+	}
+	if refund.BalanceAmount > 0 {
+		parts = append(parts, fmt.Sprintf("%.2f₽ на баланс", refund.BalanceAmount))
+	}
+	return strings.Join(parts, " и ")
+}
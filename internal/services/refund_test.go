@@ -0,0 +1,139 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// refundAPI – тестовый API возвратов Юкассы: отвечает статусом status и запоминает ключи идемпотентности.
+type refundAPI struct {
+	mu     sync.Mutex
+	status int
+	keys   []string
+}
+
+func (a *refundAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := r.Header.Get("Idempotence-Key")
+	a.keys = append(a.keys, key)
+	w.WriteHeader(a.status)
+	if a.status == http.StatusOK {
+		fmt.Fprintf(w, `{"id":"rf-%s","status":"pending","amount":{"value":"40.00","currency":"RUB"}}`, key)
+	} else {
+		w.Write([]byte(`{"type":"error","code":"invalid_request","description":"Refund rejected"}`))
+	}
+}
+
+// TestRefundPaymentIdempotenceKey проверяет, что возврат записывается в БД до запроса к Юкассе
+// и отправляется с ключом идемпотентности из своего ID, в том числе при повторной отправке.
+func TestRefundPaymentIdempotenceKey(t *testing.T) {
+	requireTestDB(t)
+	api := &refundAPI{status: http.StatusInternalServerError}
+	useYooKassaServer(t, api.ServeHTTP)
+
+	user := createTestUser(t, 0)
+	payment := createTestPayment(t, user, db.Payment{Months: 1, Amount: 100, Status: db.PaymentSucceeded})
+
+	// Сбой Юкассы: возврат остаётся pending и будет отправлен повторно.
+	refund, err := RefundPayment(&payment, 40, "тест")
+	if err != nil {
+		t.Fatalf("RefundPayment() вернул ошибку: %v", err)
+	}
+	if refund.Status != db.RefundPending || refund.YooKassaID != "" {
+		t.Fatalf("возврат после сбоя: статус %s, YooKassaID %q, ожидался неотправленный pending", refund.Status, refund.YooKassaID)
+	}
+
+	api.status = http.StatusOK
+	if err := submitRefund(refund); err != nil {
+		t.Fatalf("submitRefund() вернул ошибку: %v", err)
+	}
+
+	wantKey := fmt.Sprintf("refund-%d", refund.ID)
+	if len(api.keys) != 2 || api.keys[0] != wantKey || api.keys[1] != wantKey {
+		t.Errorf("ключи идемпотентности %q, ожидалось дважды %q", api.keys, wantKey)
+	}
+	var stored db.Refund
+	if err := db.DB.First(&stored, refund.ID).Error; err != nil {
+		t.Fatalf("возврат не найден: %v", err)
+	}
+	if stored.YooKassaID != "rf-"+wantKey || stored.Status != db.RefundPending {
+		t.Errorf("возврат в БД: YooKassaID %q, статус %s", stored.YooKassaID, stored.Status)
+	}
+}
+
+// TestRefundPaymentRejected проверяет, что отклонённый Юкассой возврат отменяется и снимает
+// зарезервированную под него сумму.
+func TestRefundPaymentRejected(t *testing.T) {
+	requireTestDB(t)
+	useYooKassaServer(t, (&refundAPI{status: http.StatusBadRequest}).ServeHTTP)
+
+	user := createTestUser(t, 0)
+	payment := createTestPayment(t, user, db.Payment{Months: 1, Amount: 100, Status: db.PaymentSucceeded})
+
+	if _, err := RefundPayment(&payment, 40, "тест"); err == nil {
+		t.Fatal("RefundPayment() должен вернуть ошибку отклонённого возврата")
+	}
+
+	var refund db.Refund
+	if err := db.DB.Where("payment_id = ?", payment.ID).First(&refund).Error; err != nil {
+		t.Fatalf("возврат не записан: %v", err)
+	}
+	if refund.Status != db.RefundCanceled {
+		t.Errorf("статус возврата %s, ожидался %s", refund.Status, db.RefundCanceled)
+	}
+	if err := db.DB.First(&payment, payment.ID).Error; err != nil {
+		t.Fatalf("платеж не найден: %v", err)
+	}
+	if payment.RefundedAmount != 0 {
+		t.Errorf("RefundedAmount = %.2f, ожидалось 0", payment.RefundedAmount)
+	}
+}
+
+// TestCompleteRefundAppliesEffects проверяет, что полный возврат покупки в одной транзакции
+// возвращает баланс, переводит платеж в refunded и отзывает подписку.
+func TestCompleteRefundAppliesEffects(t *testing.T) {
+	requireTestDB(t)
+	fake := useFakeNotifier(t)
+	_, keys := createTestServer(t, 1)
+	user := createTestUser(t, 0)
+	payment := createTestPayment(t, user, db.Payment{Months: 1, BalanceAmount: 100, Status: db.PaymentSucceeded})
+	subscription := createTestSubscription(t, user, keys[0], time.Now().AddDate(0, 1, 0))
+	db.DB.Model(&subscription).Update("payment_id", payment.ID)
+
+	refund, err := RefundPayment(&payment, 0, "тест")
+	if err != nil {
+		t.Fatalf("RefundPayment() вернул ошибку: %v", err)
+	}
+	if refund.Status != db.RefundSucceeded {
+		t.Fatalf("возврат на баланс в статусе %s, ожидался succeeded", refund.Status)
+	}
+
+	var stored db.Payment
+	db.DB.First(&stored, payment.ID)
+	if stored.Status != db.PaymentRefunded {
+		t.Errorf("платеж в статусе %s, ожидался refunded", stored.Status)
+	}
+	if balance := reloadUser(t, user).Balance; balance != 100 {
+		t.Errorf("баланс %.2f, ожидалось 100.00", balance)
+	}
+	var revoked db.Subscription
+	db.DB.First(&revoked, subscription.ID)
+	if revoked.Status != db.SubscriptionRevoked {
+		t.Errorf("подписка в статусе %s, ожидался revoked", revoked.Status)
+	}
+	requireMessage(t, fake, user, "Подписка отозвана")
+
+	// Повторное проведение того же возврата ничего не меняет.
+	if err := completeRefund(refund); err != nil {
+		t.Fatalf("повторный completeRefund() вернул ошибку: %v", err)
+	}
+	if balance := reloadUser(t, user).Balance; balance != 100 {
+		t.Errorf("после повтора баланс %.2f, ожидалось 100.00", balance)
+	}
+}
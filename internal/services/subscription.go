@@ -0,0 +1,182 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrSubscriptionRevoked возвращается при попытке продлить отозванную подписку.
+var ErrSubscriptionRevoked = errors.New("подписка отозвана и не может быть продлена")
+
+// subscriptionExpiresAt рассчитывает дату окончания подписки, начинающейся в from, на заданное число месяцев.
+func subscriptionExpiresAt(from time.Time, months int) time.Time {
+	return from.AddDate(0, months, 0)
+}
+
+// createSubscription оформляет в транзакции tx подписку по успешному платежу на выданный пользователю ключ.
+func createSubscription(tx *gorm.DB, payment db.Payment, key db.VLESSKey) (*db.Subscription, error) {
+	months := payment.Months
+	if months <= 0 {
+		// 🔴 ! Платежи, созданные до появления поля Months, считаются месячными.
+		months = 1
+	}
+
+	bonusDays, err := takeBonusDays(tx, payment.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания подписки: %v", err)
+	}
+	now := time.Now()
+	subscription := db.Subscription{
+		UserID:     payment.UserID,
+		ServerID:   key.ServerID,
+		VLESSKeyID: key.ID,
+		PaymentID:  payment.ID,
+		Months:     months,
+		StartsAt:   now,
+		ExpiresAt:  subscriptionExpiresAt(now, months).AddDate(0, 0, bonusDays),
+		Status:     db.SubscriptionActive,
+	}
+	if err := tx.Create(&subscription).Error; err != nil {
+		return nil, fmt.Errorf("ошибка создания подписки: %v", err)
+	}
+	return &subscription, nil
+}
+
+// takeBonusDays списывает накопленные бонусные дни пользователя и возвращает их количество.
+func takeBonusDays(tx *gorm.DB, userID int) (int, error) {
+	var user db.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "bonus_days").
+		First(&user, userID).Error
+	if err != nil {
+		return 0, err
+	}
+	if user.BonusDays == 0 {
+		return 0, nil
+	}
+	if err := tx.Model(&user).Update("bonus_days", 0).Error; err != nil {
+		return 0, err
+	}
+	return user.BonusDays, nil
+}
+
+// ExpireSubscriptions переводит в статус expired все активные подписки с истёкшим сроком.
+func ExpireSubscriptions() (int64, error) {
+	result := db.DB.Model(&db.Subscription{}).
+		Where("status = ? AND expires_at < ?", db.SubscriptionActive, time.Now()).
+		Update("status", db.SubscriptionExpired)
+	if result.Error != nil {
+		return 0, fmt.Errorf("ошибка обновления истёкших подписок: %v", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// extendSubscription продлевает в транзакции tx подписку, оплаченную платежом продления, сохраняя
+// прежний VLESS-ключ. Если подписка уже истекла, новый срок отсчитывается от текущего момента.
+// Оплаченная пробная подписка становится обычной.
+func extendSubscription(tx *gorm.DB, payment db.Payment) (*db.Subscription, error) {
+	if payment.SubscriptionID == nil {
+		return nil, fmt.Errorf("платеж %s не является платежом продления", payment.YooKassaID)
+	}
+
+	// Блокируем подписку, чтобы одновременно оплаченные продления сложили сроки.
+	var subscription db.Subscription
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&subscription, *payment.SubscriptionID).Error; err != nil {
+		return nil, fmt.Errorf("подписка %d не найдена: %v", *payment.SubscriptionID, err)
+	}
+	if err := checkRenewable(tx, subscription); err != nil {
+		return nil, err
+	}
+
+	bonusDays, err := takeBonusDays(tx, subscription.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка продления подписки %d: %v", subscription.ID, err)
+	}
+	from := time.Now()
+	if subscription.ExpiresAt.After(from) {
+		from = subscription.ExpiresAt
+	}
+	expiresAt := subscriptionExpiresAt(from, payment.Months).AddDate(0, 0, bonusDays)
+	if err := tx.Model(&subscription).Updates(map[string]interface{}{
+		"months":     payment.Months,
+		"expires_at": expiresAt,
+		"status":     db.SubscriptionActive,
+		"is_trial":   false,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("ошибка продления подписки %d: %v", subscription.ID, err)
+	}
+	subscription.Months = payment.Months
+	subscription.ExpiresAt = expiresAt
+	subscription.Status = db.SubscriptionActive
+	subscription.IsTrial = false
+	return &subscription, nil
+}
+
+// CheckRenewable проверяет, что подписку можно продлить: она не отозвана и её ключ
+// по-прежнему закреплён за владельцем подписки.
+func CheckRenewable(subscription db.Subscription) error {
+	return checkRenewable(db.DB, subscription)
+}
+
+// checkRenewable выполняет проверку CheckRenewable в соединении или транзакции conn.
+func checkRenewable(conn *gorm.DB, subscription db.Subscription) error {
+	if subscription.Status == db.SubscriptionRevoked {
+		return ErrSubscriptionRevoked
+	}
+	var key db.VLESSKey
+	if err := conn.Select("id", "user_id").First(&key, subscription.VLESSKeyID).Error; err != nil {
+		return fmt.Errorf("ключ подписки %d не найден: %v", subscription.ID, err)
+	}
+	if key.UserID == nil || *key.UserID != subscription.UserID {
+		return ErrSubscriptionRevoked
+	}
+	return nil
+}
+
+// RevokeSubscription досрочно завершает подписку и выводит её VLESS-ключ из оборота: ключ
+// по-прежнему действует на сервере, поэтому в пул он вернётся только после перевыпуска (ReissueKey).
+// Отозванную подписку нельзя продлить.
+func RevokeSubscription(subscription *db.Subscription) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		return revokeSubscription(tx, subscription)
+	})
+}
+
+// revokeSubscription выполняет RevokeSubscription в транзакции tx.
+func revokeSubscription(tx *gorm.DB, subscription *db.Subscription) error {
+	now := time.Now()
+	if err := tx.Model(subscription).Updates(map[string]interface{}{
+		"expires_at": now,
+		"status":     db.SubscriptionRevoked,
+		"auto_renew": false,
+	}).Error; err != nil {
+		return fmt.Errorf("ошибка отзыва подписки %d: %v", subscription.ID, err)
+	}
+	if err := retireKey(tx, subscription.VLESSKeyID); err != nil {
+		return fmt.Errorf("ошибка отзыва подписки %d: %v", subscription.ID, err)
+	}
+	subscription.ExpiresAt = now
+	subscription.Status = db.SubscriptionRevoked
+	subscription.AutoRenew = false
+	return nil
+}
+
+// shortenSubscription сокращает в транзакции tx срок подписки на d. Если срок при этом истекает,
+// подписка отзывается.
+func shortenSubscription(tx *gorm.DB, subscription *db.Subscription, d time.Duration) error {
+	expiresAt := subscription.ExpiresAt.Add(-d)
+	if !expiresAt.After(time.Now()) {
+		return revokeSubscription(tx, subscription)
+	}
+	if err := tx.Model(subscription).Update("expires_at", expiresAt).Error; err != nil {
+		return fmt.Errorf("ошибка сокращения подписки %d: %v", subscription.ID, err)
+	}
+	subscription.ExpiresAt = expiresAt
+	return nil
+}
@@ -9,38 +9,60 @@ import (
 )
 
 // SendSubscriptionReminders отправляет напоминания пользователям о скором окончании подписки.
-// Предполагается, что срок подписки рассчитывается как AssignedAt + 30 дней.
-// 🔴 ! Если у вас другая логика продления подписки, измените формулу расчета.
+// Срок подписки берётся из Subscription.ExpiresAt, а истёкшие подписки переводятся в статус expired.
+// Ключи давно истёкших неоплаченных пробных подписок выводятся из оборота.
 func SendSubscriptionReminders() {
-	var keys []db.VLESSKey
-	// Выбираем все активные подписки с установленным AssignedAt.
-	if err := db.DB.Where("is_used = ? AND assigned_at IS NOT NULL", true).Find(&keys).Error; err != nil {
+	if expired, err := ExpireSubscriptions(); err != nil {
+		log.Printf("🔴 %v", err)
+	} else if expired > 0 {
+		log.Printf("⌛ Истекло подписок: %d", expired)
+	}
+	if released, err := ReleaseExpiredTrials(); err != nil {
+		log.Printf("🔴 %v", err)
+	} else if released > 0 {
+		log.Printf("♻️ Ключей неоплаченных пробных подписок выведено из оборота: %d", released)
+	}
+
+	var subscriptions []db.Subscription
+	// Выбираем все действующие подписки вместе с серверами.
+	if err := db.DB.Preload("Server").
+		Where("status = ?", db.SubscriptionActive).
+		Find(&subscriptions).Error; err != nil {
 		log.Printf("🔴 Ошибка получения активных подписок: %v", err)
 		return
 	}
 
 	now := time.Now()
-	for _, key := range keys {
-		if key.AssignedAt == nil {
+	for _, subscription := range subscriptions {
+		daysLeft := int(subscription.ExpiresAt.Sub(now).Hours() / 24)
+
+		// За день до окончания пробного периода предлагаем перейти на платный тариф.
+		if subscription.IsTrial {
+			if daysLeft == 1 {
+				sendTrialEndingReminder(subscription)
+			}
 			continue
 		}
-		// Рассчитываем дату окончания подписки (предполагаем 30-дневный срок).
-		expiration := key.AssignedAt.Add(30 * 24 * time.Hour)
-		daysLeft := int(expiration.Sub(now).Hours() / 24)
 
 		// Отправляем уведомление, если осталось ровно 7 или 3 дня.
 		if daysLeft == 7 || daysLeft == 3 {
-			if key.UserID != nil {
-				message := fmt.Sprintf("⏳ Ваша подписка истекает через %d дней. Не забудьте продлить её!", daysLeft)
-				// Функция SendMessage реализована ниже как заглушка – замените на реальную отправку сообщений через Telegram Bot API.
-				SendMessage(int64(*key.UserID), message)
-			}
+			message := fmt.Sprintf(
+				"⏳ Ваша подписка на сервер %s истекает через %d дней (%s). Не забудьте продлить её!",
+				subscription.Server.Name, daysLeft, subscription.ExpiresAt.Format("02.01.2006"),
+			)
+			NotifyUser(subscription.UserID, message)
 		}
 	}
 }
 
-// SendMessage отправляет сообщение пользователю через Telegram.
-// 🔴 ! Замените эту заглушку на реальную реализацию отправки сообщений.
-/*func SendMessage(chatID int64, text string) {
-	log.Printf("Отправка сообщения пользователю %d: %s", chatID, text)
-}*/
+// sendTrialEndingReminder предлагает пользователю продлить пробную подписку до платной
+// с сохранением выданного ключа.
+func sendTrialEndingReminder(subscription db.Subscription) {
+	message := fmt.Sprintf(
+		"⏳ Пробный период на сервере %s заканчивается %s. Чтобы VPN продолжил работать с тем же ключом, выберите тариф:",
+		subscription.Server.Name, subscription.ExpiresAt.Format("02.01.2006 15:04"),
+	)
+	NotifyUserWithButtons(subscription.UserID, message, []Button{
+		{Text: "💳 Выбрать тариф", Data: fmt.Sprintf("renew_%d", subscription.ID)},
+	})
+}
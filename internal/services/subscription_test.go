@@ -0,0 +1,42 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// TestRevokedSubscriptionIsNotRenewable проверяет, что отозванную подписку нельзя продлить:
+// её ключ снят с пользователя и после перевыпуска достанется другому.
+func TestRevokedSubscriptionIsNotRenewable(t *testing.T) {
+	requireTestDB(t)
+	_, keys := createTestServer(t, 1)
+	user := createTestUser(t, 0)
+	subscription := createTestSubscription(t, user, keys[0], time.Now().AddDate(0, 1, 0))
+	if err := CheckRenewable(subscription); err != nil {
+		t.Fatalf("активную подписку должно быть можно продлить: %v", err)
+	}
+
+	if err := RevokeSubscription(&subscription); err != nil {
+		t.Fatalf("RevokeSubscription() вернул ошибку: %v", err)
+	}
+	if subscription.Status != db.SubscriptionRevoked {
+		t.Errorf("статус подписки %s, ожидался %s", subscription.Status, db.SubscriptionRevoked)
+	}
+	if err := CheckRenewable(subscription); !errors.Is(err, ErrSubscriptionRevoked) {
+		t.Errorf("CheckRenewable() = %v, ожидалась ErrSubscriptionRevoked", err)
+	}
+
+	var key db.VLESSKey
+	db.DB.First(&key, keys[0].ID)
+	if !key.IsUsed || key.UserID != nil || key.RetiredAt == nil {
+		t.Errorf("ключ отозванной подписки должен быть выведен из оборота: %+v", key)
+	}
+
+	payment := createTestPayment(t, user, db.Payment{SubscriptionID: &subscription.ID, Months: 1, Amount: 100})
+	if _, err := extendSubscription(db.DB, payment); !errors.Is(err, ErrSubscriptionRevoked) {
+		t.Errorf("extendSubscription() = %v, ожидалась ErrSubscriptionRevoked", err)
+	}
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+var (
+	testDBOnce sync.Once
+	testSeq    atomic.Int64
+)
+
+// requireTestDB подключает тест к PostgreSQL из DATABASE_URL и выполняет миграции.
+// Без DATABASE_URL интеграционный тест пропускается.
+func requireTestDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DATABASE_URL") == "" {
+		t.Skip("DATABASE_URL не задана – интеграционный тест пропущен")
+	}
+	testDBOnce.Do(db.InitDB)
+}
+
+// testUnique возвращает число, уникальное в пределах запуска тестов, для имён тестовых записей.
+func testUnique() int64 {
+	return time.Now().UnixNano() + testSeq.Add(1)
+}
+
+// createTestUser создаёт пользователя с балансом balance и удаляет его после теста.
+func createTestUser(t *testing.T, balance float64) db.User {
+	t.Helper()
+	now := time.Now()
+	user := db.User{TelegramID: testUnique(), Balance: balance, FirstSeenAt: now, LastSeenAt: now}
+	if err := db.DB.Create(&user).Error; err != nil {
+		t.Fatalf("ошибка создания пользователя: %v", err)
+	}
+	t.Cleanup(func() {
+		db.DB.Where("payment_id IN (?)", db.DB.Model(&db.Payment{}).Select("id").Where("user_id = ?", user.ID)).Delete(&db.Refund{})
+		db.DB.Where("user_id = ?", user.ID).Delete(&db.BalanceTransaction{})
+		db.DB.Where("user_id = ?", user.ID).Delete(&db.Subscription{})
+		db.DB.Where("user_id = ?", user.ID).Delete(&db.Payment{})
+		db.DB.Delete(&user)
+	})
+	return user
+}
+
+// createTestServer создаёт сервер с keys свободными ключами и удаляет их после теста.
+func createTestServer(t *testing.T, keys int) (db.Server, []db.VLESSKey) {
+	t.Helper()
+	unique := testUnique()
+	server := db.Server{Name: fmt.Sprintf("test-%d", unique), IP: fmt.Sprintf("test-%d", unique), IsActive: true}
+	if err := db.DB.Create(&server).Error; err != nil {
+		t.Fatalf("ошибка создания сервера: %v", err)
+	}
+
+	created := make([]db.VLESSKey, keys)
+	for i := range created {
+		created[i] = db.VLESSKey{ServerID: server.ID, Key: fmt.Sprintf("vless://test-%d-%d@example.com:443", unique, i)}
+	}
+	if keys > 0 {
+		if err := db.DB.Create(&created).Error; err != nil {
+			t.Fatalf("ошибка создания ключей: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		db.DB.Where("server_id = ?", server.ID).Delete(&db.VLESSKey{})
+		db.DB.Delete(&server)
+	})
+	return server, created
+}
+
+// createTestPayment записывает платеж пользователя по образцу payment: пустые идентификатор,
+// назначение и статус заполняются значениями по умолчанию. Платеж удаляется вместе с пользователем.
+func createTestPayment(t *testing.T, user db.User, payment db.Payment) db.Payment {
+	t.Helper()
+	payment.UserID = user.ID
+	if payment.YooKassaID == "" {
+		payment.YooKassaID = fmt.Sprintf("test-%d", testUnique())
+	}
+	if payment.Kind == "" {
+		payment.Kind = db.PaymentKindSubscription
+	}
+	if payment.Status == "" {
+		payment.Status = db.PaymentPending
+	}
+	if err := db.DB.Create(&payment).Error; err != nil {
+		t.Fatalf("ошибка создания платежа: %v", err)
+	}
+	return payment
+}
+
+// createTestSubscription выдаёт пользователю ключ key и оформляет на него активную подписку,
+// истекающую в expiresAt. Подписка удаляется вместе с пользователем.
+func createTestSubscription(t *testing.T, user db.User, key db.VLESSKey, expiresAt time.Time) db.Subscription {
+	t.Helper()
+	now := time.Now()
+	if err := db.DB.Model(&key).Updates(db.VLESSKey{IsUsed: true, UserID: &user.ID, AssignedAt: &now}).Error; err != nil {
+		t.Fatalf("ошибка выдачи ключа: %v", err)
+	}
+	subscription := db.Subscription{
+		UserID:     user.ID,
+		ServerID:   key.ServerID,
+		VLESSKeyID: key.ID,
+		Months:     1,
+		StartsAt:   now,
+		ExpiresAt:  expiresAt,
+		Status:     db.SubscriptionActive,
+	}
+	if err := db.DB.Create(&subscription).Error; err != nil {
+		t.Fatalf("ошибка создания подписки: %v", err)
+	}
+	return subscription
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+)
+
+// defaultTrialDays – длительность пробного периода, если TRIAL_DAYS не задан.
+const defaultTrialDays = 3
+
+// trialKeyGrace – сколько пробная подписка может оставаться истёкшей, прежде чем её ключ будет
+// снят с пользователя. В течение этого срока пробную подписку ещё можно продлить оплатой.
+const trialKeyGrace = 7 * 24 * time.Hour
+
+// ErrTrialUsed возвращается, если пользователь уже активировал пробный период.
+var ErrTrialUsed = errors.New("пробный период уже использован")
+
+// TrialDays возвращает длительность пробного периода в днях из TRIAL_DAYS. 0 отключает пробный период.
+func TrialDays() int {
+	value := os.Getenv("TRIAL_DAYS")
+	if value == "" {
+		return defaultTrialDays
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		log.Printf("🔴 Некорректное значение TRIAL_DAYS: %q", value)
+		return defaultTrialDays
+	}
+	return days
+}
+
+// ActivateTrial выдаёт пользователю пробную подписку на сервер без оплаты.
+// Пробный период доступен один раз: отметка TrialUsedAt ставится в той же транзакции,
+// что и выдача ключа. Если свободных ключей нет, возвращается gorm.ErrRecordNotFound.
+func ActivateTrial(user *db.User, serverID int) (*db.Subscription, *db.VLESSKey, error) {
+	var key db.VLESSKey
+	var subscription db.Subscription
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&db.User{}).
+			Where("id = ? AND trial_used_at IS NULL", user.ID).
+			Update("trial_used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTrialUsed
+		}
+
+		if err := lockFreeKey(tx, serverID, &key); err != nil {
+			return err
+		}
+		if err := tx.Model(&key).Updates(map[string]interface{}{
+			"is_used":        true,
+			"user_id":        user.ID,
+			"assigned_at":    now,
+			"reserved_until": nil,
+		}).Error; err != nil {
+			return err
+		}
+
+		subscription = db.Subscription{
+			UserID:     user.ID,
+			ServerID:   serverID,
+			VLESSKeyID: key.ID,
+			IsTrial:    true,
+			StartsAt:   now,
+			ExpiresAt:  now.AddDate(0, 0, TrialDays()),
+			Status:     db.SubscriptionActive,
+		}
+		return tx.Create(&subscription).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &subscription, &key, nil
+}
+
+// ReleaseExpiredTrials отзывает пробные подписки, которые истекли более trialKeyGrace назад и так
+// и не были оплачены, и выводит их ключи из оборота до перевыпуска (см. retireKey): иначе каждый
+// пробный период навсегда занимал бы ключ. Возвращает число отозванных подписок.
+func ReleaseExpiredTrials() (int, error) {
+	var subscriptions []db.Subscription
+	if err := db.DB.Select("id", "vless_key_id").
+		Where("is_trial = ? AND status = ? AND expires_at < ?", true, db.SubscriptionExpired, time.Now().Add(-trialKeyGrace)).
+		Find(&subscriptions).Error; err != nil {
+		return 0, fmt.Errorf("ошибка выборки истёкших пробных подписок: %v", err)
+	}
+
+	released := 0
+	for _, subscription := range subscriptions {
+		revoked := false
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			// Условие на статус и признак пробной подписки не даёт отозвать подписку,
+			// которую продлили после выборки.
+			result := tx.Model(&db.Subscription{}).
+				Where("id = ? AND is_trial = ? AND status = ?", subscription.ID, true, db.SubscriptionExpired).
+				Updates(map[string]interface{}{"status": db.SubscriptionRevoked, "auto_renew": false})
+			if result.Error != nil || result.RowsAffected == 0 {
+				return result.Error
+			}
+			revoked = true
+			return retireKey(tx, subscription.VLESSKeyID)
+		})
+		if err != nil {
+			return released, fmt.Errorf("ошибка отзыва пробной подписки %d: %v", subscription.ID, err)
+		}
+		if revoked {
+			released++
+		}
+	}
+	return released, nil
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+// createTestTrial оформляет пользователю пробную подписку, истёкшую в expiredAt.
+func createTestTrial(t *testing.T, key db.VLESSKey, expiredAt time.Time) db.Subscription {
+	t.Helper()
+	user := createTestUser(t, 0)
+	subscription := createTestSubscription(t, user, key, expiredAt)
+	if err := db.DB.Model(&subscription).Updates(map[string]interface{}{
+		"is_trial": true,
+		"status":   db.SubscriptionExpired,
+	}).Error; err != nil {
+		t.Fatalf("ошибка создания пробной подписки: %v", err)
+	}
+	return subscription
+}
+
+// TestReleaseExpiredTrials проверяет, что ключ неоплаченной пробной подписки выводится из оборота
+// только по истечении льготного срока.
+func TestReleaseExpiredTrials(t *testing.T) {
+	requireTestDB(t)
+	_, keys := createTestServer(t, 2)
+	stale := createTestTrial(t, keys[0], time.Now().Add(-trialKeyGrace-time.Hour))
+	recent := createTestTrial(t, keys[1], time.Now().Add(-time.Hour))
+
+	if _, err := ReleaseExpiredTrials(); err != nil {
+		t.Fatalf("ReleaseExpiredTrials() вернул ошибку: %v", err)
+	}
+
+	var subscription db.Subscription
+	var key db.VLESSKey
+	db.DB.First(&subscription, stale.ID)
+	db.DB.First(&key, keys[0].ID)
+	if subscription.Status != db.SubscriptionRevoked || key.UserID != nil || key.RetiredAt == nil {
+		t.Errorf("давно истёкшая пробная подписка не освободила ключ: статус %s, ключ %+v", subscription.Status, key)
+	}
+
+	db.DB.First(&subscription, recent.ID)
+	db.DB.First(&key, keys[1].ID)
+	if subscription.Status != db.SubscriptionExpired || key.UserID == nil || key.RetiredAt != nil {
+		t.Errorf("пробная подписка в льготный срок затронута: статус %s, ключ %+v", subscription.Status, key)
+	}
+	if err := CheckRenewable(subscription); err != nil {
+		t.Errorf("пробную подписку в льготный срок должно быть можно продлить: %v", err)
+	}
+}
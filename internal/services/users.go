@@ -0,0 +1,67 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"gorm.io/gorm/clause"
+)
+
+// UpsertTelegramUser создаёт пользователя по данным Telegram или обновляет его профиль и время последнего визита.
+func UpsertTelegramUser(from *tgbotapi.User) (*db.User, error) {
+	now := time.Now()
+	user := db.User{
+		TelegramID:   int64(from.ID),
+		Username:     from.UserName,
+		FirstName:    from.FirstName,
+		LanguageCode: from.LanguageCode,
+		FirstSeenAt:  now,
+		LastSeenAt:   now,
+	}
+	err := db.DB.Clauses(
+		clause.OnConflict{
+			Columns:   []clause.Column{{Name: "telegram_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"username", "first_name", "language_code", "last_seen_at", "updated_at"}),
+		},
+		clause.Returning{},
+	).Create(&user).Error
+	if err != nil {
+		return nil, fmt.Errorf("ошибка сохранения пользователя: %v", err)
+	}
+	return &user, nil
+}
+
+// TelegramID возвращает Telegram ID пользователя по его ID в БД.
+func TelegramID(userID int) (int64, error) {
+	var user db.User
+	if err := db.DB.Select("telegram_id").First(&user, userID).Error; err != nil {
+		return 0, fmt.Errorf("пользователь %d не найден: %v", userID, err)
+	}
+	return user.TelegramID, nil
+}
+
+// NotifyUserWithButtons отправляет пользователю по его ID в БД сообщение с inline-кнопками.
+func NotifyUserWithButtons(userID int, text string, buttons []Button) {
+	chatID, err := TelegramID(userID)
+	if err != nil {
+		log.Printf("🔴 Ошибка отправки сообщения: %v", err)
+		return
+	}
+	if err := currentNotifier().SendButtons(chatID, text, buttons); err != nil {
+		log.Printf("🔴 Ошибка отправки сообщения пользователю %d: %v", chatID, err)
+	}
+}
+
+// NotifyUser отправляет сообщение пользователю по его ID в БД.
+func NotifyUser(userID int, text string) {
+	chatID, err := TelegramID(userID)
+	if err != nil {
+		log.Printf("🔴 Ошибка отправки сообщения: %v", err)
+		return
+	}
+	SendMessage(chatID, text)
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"vpn-bot/internal/db"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxWebhookAttempts – после стольких неудачных попыток уведомление помечается как failed.
+const maxWebhookAttempts = 10
+
+// Интервалы повторной обработки уведомления: webhookRetryBase, удваиваемый с каждой
+// попыткой, но не больше webhookRetryMax.
+const (
+	webhookRetryBase = time.Minute
+	webhookRetryMax  = time.Hour
+)
+
+// webhookLease – на сколько уведомление закрепляется за взявшим его обработчиком. Если обработчик
+// завершился, не записав результат, по истечении аренды уведомление снова станет доступно.
+const webhookLease = 5 * time.Minute
+
+// webhookAlertInterval – администратор получает сообщение о необработанных уведомлениях не чаще
+// раза в этот интервал. Неудачи, случившиеся между сообщениями, сводятся в следующее сообщение.
+const webhookAlertInterval = 10 * time.Minute
+
+// MaxWebhookBodySize – максимальный размер тела уведомления, которое принимает бот.
+const MaxWebhookBodySize = 64 << 10
+
+// ErrInvalidWebhook возвращается StoreWebhookEvent, если тело не является уведомлением Юкассы.
+var ErrInvalidWebhook = errors.New("тело не является уведомлением Юкассы")
+
+// webhookAlerts копит неудачи обработки уведомлений до следующего сообщения администратору.
+var webhookAlerts struct {
+	sync.Mutex
+	lastSent time.Time
+	first    string // Описание первой неудачи с прошлого сообщения
+	pending  int    // Сколько неудач ещё не сообщено
+}
+
+// permanentError – ошибка обработки уведомления, которую повторная попытка не исправит
+// (например, некорректное тело или несовпадение суммы платежа).
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// webhookHandler обрабатывает уведомление Юкассы определённого типа. Возвращённая ошибка
+// приводит к повторной попытке, если это не permanentError.
+type webhookHandler func(event *YooKassaEvent) error
+
+// webhookHandlers – обработчики уведомлений Юкассы по типу события.
+var webhookHandlers = map[string]webhookHandler{
+	EventPaymentSucceeded:         handlePaymentEvent,
+	EventPaymentWaitingForCapture: handlePaymentEvent,
+	EventPaymentCanceled:          handlePaymentEvent,
+	EventRefundSucceeded:          handleRefundEvent,
+}
+
+// StoreWebhookEvent сохраняет входящее уведомление Юкассы в очередь на обработку. Тело, которое
+// не разбирается как уведомление с событием и ID объекта, не сохраняется: возвращается ошибка,
+// обёртывающая ErrInvalidWebhook. Содержимому объекта бот не доверяет – обработчики
+// перезапрашивают объект у Юкассы по ID.
+func StoreWebhookEvent(body []byte, headers http.Header, remoteAddr string) (*db.WebhookEvent, error) {
+	decoded, err := DecodeYooKassaEvent(body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWebhook, err)
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(decoded.Object, &object); err != nil || object.ID == "" {
+		return nil, fmt.Errorf("%w: в уведомлении %s нет ID объекта", ErrInvalidWebhook, decoded.Event)
+	}
+
+	headersJSON, err := json.Marshal(headers)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка кодирования заголовков уведомления: %v", err)
+	}
+
+	now := time.Now()
+	event := db.WebhookEvent{
+		Body:          string(body),
+		Headers:       string(headersJSON),
+		RemoteAddr:    remoteAddr,
+		Event:         decoded.Event,
+		ObjectID:      object.ID,
+		Status:        db.WebhookEventPending,
+		NextAttemptAt: now,
+		ReceivedAt:    now,
+	}
+
+	if err := db.DB.Create(&event).Error; err != nil {
+		return nil, fmt.Errorf("ошибка сохранения уведомления: %v", err)
+	}
+	return &event, nil
+}
+
+// ProcessWebhookEvents обрабатывает все уведомления из очереди, время обработки которых наступило.
+// Вызывается сразу после получения уведомления и по расписанию для повторных попыток.
+func ProcessWebhookEvents() {
+	defer flushWebhookAlerts()
+	for {
+		found, err := processNextWebhookEvent()
+		if err != nil {
+			log.Printf("🔴 Ошибка обработки очереди уведомлений: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+// processNextWebhookEvent берёт одно уведомление, время обработки которого наступило, и обрабатывает
+// его вне транзакции: запросы к Юкассе и отправка сообщений не удерживают блокировку строки.
+// Возвращает false, если обрабатывать нечего.
+func processNextWebhookEvent() (bool, error) {
+	event, err := claimWebhookEvent()
+	if err != nil || event == nil {
+		return false, err
+	}
+
+	// Результат записывается, только если уведомление всё ещё закреплено за этой попыткой:
+	// по истечении аренды его мог взять другой обработчик.
+	result := db.DB.Model(&db.WebhookEvent{}).
+		Where("id = ? AND status = ? AND attempts = ?", event.ID, db.WebhookEventProcessing, event.Attempts).
+		Updates(processWebhookEvent(event))
+	if result.Error != nil {
+		return true, fmt.Errorf("ошибка записи результата обработки уведомления #%d: %v", event.ID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("⚠️ Аренда уведомления #%d истекла до окончания обработки – результат не записан", event.ID)
+	}
+	return true, nil
+}
+
+// claimWebhookEvent закрепляет за вызывающим одно уведомление: ожидающее обработки или
+// брошенное обработчиком, чья аренда истекла. Строка выбирается через SELECT ... FOR UPDATE
+// SKIP LOCKED и сразу переводится в статус processing с арендой webhookLease, после чего
+// транзакция фиксируется. Счётчик попыток увеличивается при закреплении и служит признаком
+// попытки при записи результата. Возвращает nil, если обрабатывать нечего.
+func claimWebhookEvent() (*db.WebhookEvent, error) {
+	var event db.WebhookEvent
+	found := false
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status IN ? AND next_attempt_at <= ?", []string{db.WebhookEventPending, db.WebhookEventProcessing}, now).
+			Order("id").
+			First(&event).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		event.Status = db.WebhookEventProcessing
+		event.Attempts++
+		event.NextAttemptAt = now.Add(webhookLease)
+		found = true
+		return tx.Model(&event).Updates(map[string]interface{}{
+			"status":          event.Status,
+			"attempts":        event.Attempts,
+			"next_attempt_at": event.NextAttemptAt,
+		}).Error
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// processWebhookEvent выполняет попытку обработки закреплённого уведомления и возвращает
+// изменения его записи.
+func processWebhookEvent(event *db.WebhookEvent) map[string]interface{} {
+	err := dispatchWebhookEvent([]byte(event.Body))
+	now := time.Now()
+	updates := map[string]interface{}{}
+
+	var permanent permanentError
+	switch {
+	case err == nil:
+		updates["status"] = db.WebhookEventProcessed
+		updates["processed_at"] = now
+		updates["error"] = ""
+	case errors.As(err, &permanent) || event.Attempts >= maxWebhookAttempts:
+		log.Printf("🔴 Уведомление #%d не обработано: %v", event.ID, err)
+		updates["status"] = db.WebhookEventFailed
+		updates["error"] = err.Error()
+		alertWebhookFailure(fmt.Sprintf("🔴 Уведомление Юкассы #%d (%s %s) не обработано: %v\nПовторить: /replaywebhook %d",
+			event.ID, event.Event, event.ObjectID, err, event.ID))
+	default:
+		log.Printf("⚠️ Уведомление #%d будет обработано повторно: %v", event.ID, err)
+		updates["status"] = db.WebhookEventPending
+		updates["error"] = err.Error()
+		updates["next_attempt_at"] = now.Add(webhookRetryDelay(event.Attempts))
+	}
+	return updates
+}
+
+// alertWebhookFailure сообщает администратору о необработанном уведомлении с учётом
+// webhookAlertInterval: если сообщение недавно отправлялось, неудача откладывается до следующего.
+func alertWebhookFailure(text string) {
+	webhookAlerts.Lock()
+	if webhookAlerts.pending == 0 {
+		webhookAlerts.first = text
+	}
+	webhookAlerts.pending++
+	webhookAlerts.Unlock()
+	flushWebhookAlerts()
+}
+
+// flushWebhookAlerts отправляет администратору накопленные неудачи, если с прошлого сообщения
+// прошло не меньше webhookAlertInterval.
+func flushWebhookAlerts() {
+	webhookAlerts.Lock()
+	if webhookAlerts.pending == 0 || time.Since(webhookAlerts.lastSent) < webhookAlertInterval {
+		webhookAlerts.Unlock()
+		return
+	}
+	text := webhookAlerts.first
+	if webhookAlerts.pending > 1 {
+		text += fmt.Sprintf("\n\nЕщё не обработано уведомлений: %d. Список: /webhooks", webhookAlerts.pending-1)
+	}
+	webhookAlerts.lastSent = time.Now()
+	webhookAlerts.first = ""
+	webhookAlerts.pending = 0
+	webhookAlerts.Unlock()
+
+	notifyAdmin(text)
+}
+
+// webhookRetryDelay возвращает задержку перед следующей попыткой после attempts неудачных.
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	return delay
+}
+
+// dispatchWebhookEvent разбирает тело уведомления и передаёт его обработчику типа события.
+func dispatchWebhookEvent(body []byte) error {
+	event, err := DecodeYooKassaEvent(body)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	handler, ok := webhookHandlers[event.Event]
+	if !ok {
+		// Неизвестные события считаем обработанными, чтобы не повторять их.
+		log.Printf("⚠️ Необрабатываемое событие Юкассы: %s", event.Event)
+		return nil
+	}
+	return handler(event)
+}
+
+// handlePaymentEvent обрабатывает события payment.*. Объекту из уведомления бот не доверяет:
+// статус и сумма платежа перепроверяются запросом к API Юкассы.
+func handlePaymentEvent(event *YooKassaEvent) error {
+	notified, err := event.Payment()
+	if err != nil {
+		return permanentError{err}
+	}
+	log.Printf("Обработка уведомления %s: PaymentID=%s, статус=%s", event.Event, notified.ID, notified.Status)
+
+	// Уведомление может прийти раньше, чем платеж записан в БД, – тогда повторим попытку позже.
+	var payment db.Payment
+	if err := db.DB.Where("yoo_kassa_id = ?", notified.ID).First(&payment).Error; err != nil {
+		return fmt.Errorf("платеж с ID %s не найден: %v", notified.ID, err)
+	}
+
+	// Запрашиваем платеж у Юкассы: поддельное уведомление не должно менять статус.
+	paymentResp, err := GetYooKassaPayment(notified.ID)
+	if err != nil {
+		return fmt.Errorf("ошибка проверки платежа %s в Юкассе: %v", notified.ID, err)
+	}
+	// Повтор не исправит только расхождение данных платежа; ошибки API Юкассы повторяются.
+	if err := VerifyYooKassaPayment(payment, paymentResp); err != nil {
+		return permanentError{err}
+	}
+	status := paymentResp.Status
+	if status != notified.Status {
+		log.Printf("⚠️ Статус платежа %s в уведомлении (%s) расходится с Юкассой (%s)", notified.ID, notified.Status, status)
+	}
+
+	UpdateReceiptStatus(&payment, paymentResp.ReceiptRegistration)
+	if details := paymentResp.CancellationDetails; details != nil {
+		log.Printf("Платеж %s отменён: %s (%s)", payment.YooKassaID, details.Reason, details.Party)
+	}
+
+	// Статус меняется под блокировкой: при повторной доставке уведомления или гонке с проверкой
+	// зависших платежей платеж исполнит только тот, кто перевёл его в новый статус.
+	changed, err := ApplyPaymentStatus(&payment, status)
+	if errors.Is(err, ErrInvalidPaymentTransition) {
+		// Устаревшее уведомление (например, canceled после succeeded) пропускаем без действий.
+		log.Printf("⚠️ %v", err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !changed && status != db.PaymentPending {
+		log.Printf("Платеж %s уже в статусе %s – повторное уведомление пропущено", payment.YooKassaID, status)
+	}
+	return nil
+}
+
+// handleRefundEvent обрабатывает событие refund.succeeded: статус возврата перепроверяется
+// запросом к API Юкассы и проводится в БД.
+func handleRefundEvent(event *YooKassaEvent) error {
+	refund, err := event.Refund()
+	if err != nil {
+		return permanentError{err}
+	}
+	log.Printf("Обработка уведомления %s: RefundID=%s, PaymentID=%s", event.Event, refund.ID, refund.PaymentID)
+
+	if err := SyncRefund(refund.ID); err != nil {
+		return fmt.Errorf("ошибка обработки возврата %s: %v", refund.ID, err)
+	}
+	return nil
+}
+
+// ReplayWebhookEvent заново ставит уведомление в очередь и сразу обрабатывает очередь.
+// Повтор уже обработанного уведомления безопасен: переходы статусов платежа идемпотентны.
+// Уведомление, которое сейчас обрабатывается, не сбрасывается.
+func ReplayWebhookEvent(eventID int) (*db.WebhookEvent, error) {
+	result := db.DB.Model(&db.WebhookEvent{}).
+		Where("id = ? AND status <> ?", eventID, db.WebhookEventProcessing).
+		Updates(map[string]interface{}{
+			"status":          db.WebhookEventPending,
+			"next_attempt_at": time.Now(),
+			"error":           "",
+		})
+	if result.Error != nil {
+		return nil, fmt.Errorf("ошибка повтора уведомления #%d: %v", eventID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		var event db.WebhookEvent
+		if err := db.DB.First(&event, eventID).Error; err != nil {
+			return nil, fmt.Errorf("уведомление #%d не найдено", eventID)
+		}
+		return nil, fmt.Errorf("уведомление #%d сейчас обрабатывается", eventID)
+	}
+
+	ProcessWebhookEvents()
+
+	var event db.WebhookEvent
+	if err := db.DB.First(&event, eventID).Error; err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// RecentWebhookEvents возвращает последние уведомления, которые ещё не обработаны успешно.
+func RecentWebhookEvents(limit int) ([]db.WebhookEvent, error) {
+	var events []db.WebhookEvent
+	err := db.DB.Where("status <> ?", db.WebhookEventProcessed).
+		Order("id DESC").
+		Limit(limit).
+		Find(&events).Error
+	return events, err
+}
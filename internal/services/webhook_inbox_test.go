@@ -0,0 +1,148 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"vpn-bot/internal/db"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, webhookRetryMax},
+		{maxWebhookAttempts, webhookRetryMax},
+	}
+	for _, tt := range tests {
+		if got := webhookRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("webhookRetryDelay(%d) = %v, ожидалось %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// storeTestWebhookEvent сохраняет уведомление неизвестного боту типа – его обработка всегда
+// успешна – и удаляет его после теста.
+func storeTestWebhookEvent(t *testing.T) *db.WebhookEvent {
+	t.Helper()
+	event, err := StoreWebhookEvent([]byte(`{"type":"notification","event":"test.event","object":{"id":"test"}}`), http.Header{}, "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("StoreWebhookEvent() вернул ошибку: %v", err)
+	}
+	t.Cleanup(func() { db.DB.Delete(event) })
+	return event
+}
+
+// reloadWebhookEvent возвращает уведомление из БД.
+func reloadWebhookEvent(t *testing.T, event *db.WebhookEvent) db.WebhookEvent {
+	t.Helper()
+	var stored db.WebhookEvent
+	if err := db.DB.First(&stored, event.ID).Error; err != nil {
+		t.Fatalf("уведомление #%d не найдено: %v", event.ID, err)
+	}
+	return stored
+}
+
+// TestWebhookEventLease проверяет, что уведомление, закреплённое за обработчиком, не берётся
+// повторно до истечения аренды и не сбрасывается повтором, а брошенное – обрабатывается заново.
+func TestWebhookEventLease(t *testing.T) {
+	requireTestDB(t)
+	event := storeTestWebhookEvent(t)
+	lease := func(until time.Time) {
+		t.Helper()
+		if err := db.DB.Model(event).Updates(map[string]interface{}{
+			"status":          db.WebhookEventProcessing,
+			"attempts":        1,
+			"next_attempt_at": until,
+		}).Error; err != nil {
+			t.Fatalf("ошибка закрепления уведомления: %v", err)
+		}
+	}
+
+	// Аренда действует: уведомление обрабатывает другой обработчик.
+	lease(time.Now().Add(webhookLease))
+	ProcessWebhookEvents()
+	if stored := reloadWebhookEvent(t, event); stored.Status != db.WebhookEventProcessing || stored.Attempts != 1 {
+		t.Fatalf("уведомление с действующей арендой взято повторно: статус %s, попыток %d", stored.Status, stored.Attempts)
+	}
+	if _, err := ReplayWebhookEvent(event.ID); err == nil || !strings.Contains(err.Error(), "обрабатывается") {
+		t.Errorf("ReplayWebhookEvent() = %v, ожидалась ошибка об обработке", err)
+	}
+
+	// Аренда истекла: обработчик завершился, не записав результат.
+	lease(time.Now().Add(-time.Second))
+	ProcessWebhookEvents()
+	stored := reloadWebhookEvent(t, event)
+	if stored.Status != db.WebhookEventProcessed || stored.Attempts != 2 || stored.ProcessedAt == nil {
+		t.Errorf("брошенное уведомление не обработано: статус %s, попыток %d", stored.Status, stored.Attempts)
+	}
+}
+
+func TestStoreWebhookEventRejectsInvalidBody(t *testing.T) {
+	bodies := map[string]string{
+		"не JSON":        "hello",
+		"без события":    `{"type":"notification","object":{"id":"test"}}`,
+		"без объекта":    `{"type":"notification","event":"payment.succeeded"}`,
+		"без ID объекта": `{"type":"notification","event":"payment.succeeded","object":{"status":"succeeded"}}`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			if _, err := StoreWebhookEvent([]byte(body), http.Header{}, "127.0.0.1:80"); !errors.Is(err, ErrInvalidWebhook) {
+				t.Errorf("StoreWebhookEvent() = %v, ожидалась ErrInvalidWebhook", err)
+			}
+		})
+	}
+}
+
+// resetWebhookAlerts сбрасывает накопленные сообщения о неудачах до и после теста.
+func resetWebhookAlerts(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		webhookAlerts.Lock()
+		webhookAlerts.lastSent = time.Time{}
+		webhookAlerts.first = ""
+		webhookAlerts.pending = 0
+		webhookAlerts.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestAlertWebhookFailureAggregates(t *testing.T) {
+	fake := useFakeNotifier(t)
+	resetWebhookAlerts(t)
+	t.Setenv("ADMIN_TELEGRAM_ID", "1")
+
+	alertWebhookFailure("первая")
+	alertWebhookFailure("вторая")
+	alertWebhookFailure("третья")
+	if messages := fake.Messages(); len(messages) != 1 || messages[0].Text != "первая" {
+		t.Fatalf("до истечения интервала ожидалось одно сообщение, отправлено: %+v", messages)
+	}
+
+	// Интервал истёк: отложенные неудачи сводятся в одно сообщение.
+	webhookAlerts.Lock()
+	webhookAlerts.lastSent = time.Now().Add(-webhookAlertInterval)
+	webhookAlerts.Unlock()
+	flushWebhookAlerts()
+	messages := fake.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("отправлено сообщений: %d, ожидалось 2", len(messages))
+	}
+	if !strings.HasPrefix(messages[1].Text, "вторая") || !strings.Contains(messages[1].Text, "Ещё не обработано уведомлений: 1") {
+		t.Errorf("неожиданное сводное сообщение: %q", messages[1].Text)
+	}
+
+	flushWebhookAlerts()
+	if len(fake.Messages()) != 2 {
+		t.Errorf("без новых неудач сообщение отправлено повторно")
+	}
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"vpn-bot/internal/db"
+)
+
+// yooKassaNetworks – опубликованные Юкассой адреса, с которых приходят уведомления.
+// 🔴 ! Сверяйте список с документацией Юкассы: https://yookassa.ru/developers/using-api/webhooks
+var yooKassaNetworks = []string{
+	"185.71.76.0/27",
+	"185.71.77.0/27",
+	"77.75.153.0/25",
+	"77.75.156.11/32",
+	"77.75.156.35/32",
+	"77.75.154.128/25",
+	"2a02:5180::/32",
+}
+
+// ErrPaymentMismatch возвращается, если данные платежа в Юкассе не совпадают с платежом в БД.
+var ErrPaymentMismatch = errors.New("данные платежа в Юкассе не совпадают с платежом в БД")
+
+// WebhookIPCheckEnabled сообщает, включена ли проверка адреса отправителя уведомлений.
+// Проверка включена по умолчанию и отключается только явно: YOOKASSA_WEBHOOK_IP_CHECK=false.
+func WebhookIPCheckEnabled() bool {
+	return os.Getenv("YOOKASSA_WEBHOOK_IP_CHECK") != "false"
+}
+
+// IsYooKassaRequest проверяет, что запрос пришёл с адреса Юкассы. Если бот стоит за
+// обратным прокси (YOOKASSA_WEBHOOK_TRUST_PROXY=true), адрес берётся из X-Real-IP
+// или первого адреса X-Forwarded-For.
+func IsYooKassaRequest(r *http.Request) bool {
+	host := r.RemoteAddr
+	if os.Getenv("YOOKASSA_WEBHOOK_TRUST_PROXY") == "true" {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			host = realIP
+		} else if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range yooKassaNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("🔴 Некорректная сеть Юкассы %q: %v", cidr, err)
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyYooKassaPayment сверяет данные платежа, полученные из API Юкассы, с платежом в БД:
+// идентификатор, сумму, валюту и пользователя из метаданных.
+func VerifyYooKassaPayment(payment db.Payment, paymentResp *YooKassaResponse) error {
+	expected := yooKassaAmount(payment.Amount)
+	switch {
+	case paymentResp.ID != payment.YooKassaID:
+		return fmt.Errorf("%w: ID %s вместо %s", ErrPaymentMismatch, paymentResp.ID, payment.YooKassaID)
+	case paymentResp.Amount.Value != expected.Value || paymentResp.Amount.Currency != expected.Currency:
+		return fmt.Errorf("%w: сумма %s %s вместо %s %s", ErrPaymentMismatch,
+			paymentResp.Amount.Value, paymentResp.Amount.Currency, expected.Value, expected.Currency)
+	case fmt.Sprint(paymentResp.Metadata["user_id"]) != strconv.Itoa(payment.UserID):
+		return fmt.Errorf("%w: пользователь %v вместо %d", ErrPaymentMismatch, paymentResp.Metadata["user_id"], payment.UserID)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsYooKassaRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		trustProxy bool
+		want       bool
+	}{
+		{"адрес Юкассы", "185.71.76.5:443", nil, false, true},
+		{"отдельный адрес Юкассы", "77.75.156.11:1234", nil, false, true},
+		{"IPv6 Юкассы", "[2a02:5180::1]:443", nil, false, true},
+		{"чужой адрес", "203.0.113.7:443", nil, false, false},
+		{"некорректный адрес", "not-an-ip", nil, false, false},
+		{"заголовки прокси без доверия", "127.0.0.1:80", map[string]string{"X-Real-IP": "185.71.76.5"}, false, false},
+		{"X-Real-IP за прокси", "127.0.0.1:80", map[string]string{"X-Real-IP": "185.71.76.5"}, true, true},
+		{"X-Forwarded-For за прокси", "127.0.0.1:80", map[string]string{"X-Forwarded-For": "185.71.77.1, 10.0.0.1"}, true, true},
+		{"чужой X-Forwarded-For за прокси", "127.0.0.1:80", map[string]string{"X-Forwarded-For": "203.0.113.7, 185.71.77.1"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.trustProxy {
+				t.Setenv("YOOKASSA_WEBHOOK_TRUST_PROXY", "true")
+			} else {
+				t.Setenv("YOOKASSA_WEBHOOK_TRUST_PROXY", "")
+			}
+			r := httptest.NewRequest("POST", "/yookassa-webhook", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if got := IsYooKassaRequest(r); got != tt.want {
+				t.Errorf("IsYooKassaRequest() = %v, ожидалось %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookIPCheckEnabled(t *testing.T) {
+	for value, want := range map[string]bool{"": true, "true": true, "false": false} {
+		t.Setenv("YOOKASSA_WEBHOOK_IP_CHECK", value)
+		if got := WebhookIPCheckEnabled(); got != want {
+			t.Errorf("WebhookIPCheckEnabled() при %q = %v, ожидалось %v", value, got, want)
+		}
+	}
+}
@@ -11,10 +11,14 @@ import (
 
 // YooKassaPaymentRequest структура запроса на создание платежа в Юкассе
 type YooKassaPaymentRequest struct {
-	Amount   YooKassaAmount   `json:"amount"`
-	Capture  bool             `json:"capture"`
-	Payment  YooKassaPayment  `json:"payment_method_data"`
-	Metadata YooKassaMetadata `json:"metadata"`
+	Amount            YooKassaAmount        `json:"amount"`
+	Capture           bool                  `json:"capture"`
+	Payment           *YooKassaPayment      `json:"payment_method_data,omitempty"`
+	Confirmation      *YooKassaConfirmation `json:"confirmation,omitempty"`
+	PaymentMethodID   string                `json:"payment_method_id,omitempty"`   // Сохранённый способ оплаты для повторного списания
+	SavePaymentMethod bool                  `json:"save_payment_method,omitempty"` // Сохранить способ оплаты для автопродления
+	Receipt           *YooKassaReceipt      `json:"receipt,omitempty"`             // Чек 54-ФЗ
+	Metadata          YooKassaMetadata      `json:"metadata"`
 }
 
 // YooKassaAmount структура суммы платежа
@@ -28,77 +32,207 @@ type YooKassaPayment struct {
 	Type string `json:"type"`
 }
 
-// YooKassaMetadata дополнительные метаданные (например, ID пользователя)
+// YooKassaConfirmation структура сценария подтверждения платежа
+type YooKassaConfirmation struct {
+	Type      string `json:"type"`
+	ReturnURL string `json:"return_url"` // Куда вернуть пользователя после оплаты
+}
+
+// YooKassaMetadata дополнительные метаданные (ID пользователя в БД бота)
 type YooKassaMetadata struct {
 	UserID int `json:"user_id"`
 }
 
+// YooKassaPaymentMethod структура способа оплаты в ответе Юкассы
+type YooKassaPaymentMethod struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Saved bool   `json:"saved"`
+	Title string `json:"title"` // Название для отображения, например "Bank card *4444"
+}
+
 // YooKassaResponse структура ответа от Юкассы
 type YooKassaResponse struct {
-	ID      string `json:"id"`
-	Status  string `json:"status"`
-	Confirm struct {
+	ID       string                 `json:"id"`
+	Status   string                 `json:"status"`
+	Paid     bool                   `json:"paid"`
+	Amount   YooKassaAmount         `json:"amount"`
+	Metadata map[string]interface{} `json:"metadata"` // Юкасса возвращает значения метаданных строками
+	Confirm  struct {
 		ConfirmationURL string `json:"confirmation_url"`
 	} `json:"confirmation"`
+	PaymentMethod       YooKassaPaymentMethod        `json:"payment_method"`
+	ReceiptRegistration string                       `json:"receipt_registration"` // Статус регистрации чека
+	CancellationDetails *YooKassaCancellationDetails `json:"cancellation_details,omitempty"`
 }
 
-// CreateYooKassaPayment создаёт платёж через Юкассу
-func CreateYooKassaPayment(userID int64, amount float64) (string, string, error) {
-	url := "https://api.yookassa.ru/v3/payments"
-
-	// Форматируем сумму в строку с двумя знаками после запятой
-	amountStr := fmt.Sprintf("%.2f", amount)
-
+// CreateYooKassaPayment создаёт платёж через Юкассу способом methodType (например, "bank_card"
+// или "sbp") с чеком receipt. После оплаты пользователь возвращается по ReturnURL. При
+// savePaymentMethod Юкасса сохранит способ оплаты для последующих автоматических списаний.
+func CreateYooKassaPayment(userID int, amount float64, methodType string, savePaymentMethod bool, receipt *YooKassaReceipt) (string, string, error) {
 	// Формируем JSON-запрос
 	requestBody := YooKassaPaymentRequest{
-		Amount: YooKassaAmount{
-			Value:    amountStr,
-			Currency: "RUB",
-		},
+		Amount:  yooKassaAmount(amount),
 		Capture: true,
-		Payment: YooKassaPayment{
-			Type: "bank_card",
+		Payment: &YooKassaPayment{
+			Type: methodType,
+		},
+		Confirmation: &YooKassaConfirmation{
+			Type:      "redirect",
+			ReturnURL: ReturnURL(),
 		},
+		SavePaymentMethod: savePaymentMethod,
+		Receipt:           receipt,
 		Metadata: YooKassaMetadata{
-			UserID: int(userID),
+			UserID: userID,
 		},
 	}
 
+	// Уникальный ключ для предотвращения дублирования
+	idempotenceKey := fmt.Sprintf("%d-%d", userID, time.Now().UnixNano())
+	yooResp, err := sendYooKassaPayment(idempotenceKey, requestBody)
+	if err != nil {
+		return "", "", err
+	}
+
+	if yooResp.ID == "" || yooResp.Confirm.ConfirmationURL == "" {
+		return "", "", fmt.Errorf("невалидный ответ Юкассы")
+	}
+
+	// Возвращаем ID платежа и URL для оплаты
+	return yooResp.ID, yooResp.Confirm.ConfirmationURL, nil
+}
+
+// ChargeSavedPaymentMethod создаёт платёж с сохранённым способом оплаты без участия пользователя.
+// Ключ идемпотентности строится из ID платежа в БД paymentID: повторная отправка того же платежа
+// не спишет деньги второй раз.
+func ChargeSavedPaymentMethod(paymentID, userID int, amount float64, paymentMethodID string, receipt *YooKassaReceipt) (*YooKassaResponse, error) {
+	requestBody := YooKassaPaymentRequest{
+		Amount:          yooKassaAmount(amount),
+		Capture:         true,
+		PaymentMethodID: paymentMethodID,
+		Receipt:         receipt,
+		Metadata: YooKassaMetadata{
+			UserID: userID,
+		},
+	}
+
+	yooResp, err := sendYooKassaPayment(fmt.Sprintf("charge-%d", paymentID), requestBody)
+	if err != nil {
+		return nil, err
+	}
+	if yooResp.ID == "" {
+		return nil, fmt.Errorf("невалидный ответ Юкассы")
+	}
+	return yooResp, nil
+}
+
+// defaultReturnURL – адрес возврата после оплаты, если YOOKASSA_RETURN_URL не задан.
+// Бот при запуске подставляет сюда ссылку на себя.
+var defaultReturnURL string
+
+// SetDefaultReturnURL задаёт адрес возврата после оплаты по умолчанию.
+func SetDefaultReturnURL(url string) {
+	defaultReturnURL = url
+}
+
+// ReturnURL возвращает адрес, на который Юкасса вернёт пользователя после оплаты.
+func ReturnURL() string {
+	if url := os.Getenv("YOOKASSA_RETURN_URL"); url != "" {
+		return url
+	}
+	return defaultReturnURL
+}
+
+// yooKassaAmount форматирует сумму в рублях с двумя знаками после запятой.
+func yooKassaAmount(amount float64) YooKassaAmount {
+	return YooKassaAmount{
+		Value:    fmt.Sprintf("%.2f", amount),
+		Currency: "RUB",
+	}
+}
+
+// sendYooKassaPayment отправляет запрос на создание платежа в Юкассу с ключом идемпотентности
+// idempotenceKey и декодирует ответ.
+func sendYooKassaPayment(idempotenceKey string, requestBody YooKassaPaymentRequest) (*YooKassaResponse, error) {
+	var yooResp YooKassaResponse
+	if err := postYooKassa("/payments", idempotenceKey, requestBody, &yooResp); err != nil {
+		return nil, err
+	}
+	return &yooResp, nil
+}
+
+// yooKassaAPIURL – базовый адрес API Юкассы.
+var yooKassaAPIURL = "https://api.yookassa.ru/v3"
+
+// YooKassaError – ответ API Юкассы с HTTP-статусом вне диапазона 2xx.
+type YooKassaError struct {
+	StatusCode  int
+	Code        string `json:"code"`        // Код ошибки, например "invalid_request"
+	Description string `json:"description"` // Описание ошибки от Юкассы
+}
+
+func (e *YooKassaError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("Юкасса вернула HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("Юкасса вернула HTTP %d: %s (%s)", e.StatusCode, e.Description, e.Code)
+}
+
+// Temporary сообщает, что запрос стоит повторить позже: Юкасса ограничила частоту запросов
+// или ответила внутренней ошибкой. Остальные ошибки повтор того же запроса не исправит.
+func (e *YooKassaError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// postYooKassa отправляет POST-запрос к API Юкассы и декодирует ответ в out.
+func postYooKassa(path, idempotenceKey string, requestBody, out interface{}) error {
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
-		return "", "", fmt.Errorf("ошибка кодирования JSON: %v", err)
+		return fmt.Errorf("ошибка кодирования JSON: %v", err)
 	}
 
 	// Подготавливаем HTTP-запрос
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequest("POST", yooKassaAPIURL+path, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", "", fmt.Errorf("ошибка создания HTTP-запроса: %v", err)
+		return fmt.Errorf("ошибка создания HTTP-запроса: %v", err)
 	}
+	req.Header.Set("Idempotence-Key", idempotenceKey)
+	return doYooKassa(req, out)
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Idempotence-Key", fmt.Sprintf("%d", time.Now().Unix())) // Уникальный ключ для предотвращения дублирования
+// getYooKassa отправляет GET-запрос к API Юкассы и декодирует ответ в out.
+func getYooKassa(path string, out interface{}) error {
+	req, err := http.NewRequest("GET", yooKassaAPIURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("ошибка создания запроса: %v", err)
+	}
+	return doYooKassa(req, out)
+}
 
-	// 🔴 ! Вставьте свои ключи из .env
+// doYooKassa выполняет запрос к API Юкассы и декодирует успешный ответ в out.
+// Ответ с HTTP-статусом вне диапазона 2xx возвращается как *YooKassaError.
+func doYooKassa(req *http.Request, out interface{}) error {
+	req.Header.Set("Content-Type", "application/json")
+	// 🔴 ! Убедитесь, что переменные YOOKASSA_SHOP_ID и YOOKASSA_SECRET_KEY заданы в .env.
 	req.SetBasicAuth(os.Getenv("YOOKASSA_SHOP_ID"), os.Getenv("YOOKASSA_SECRET_KEY"))
 
-	// Отправляем запрос
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", "", fmt.Errorf("ошибка отправки запроса: %v", err)
+		return fmt.Errorf("ошибка отправки запроса: %v", err)
 	}
 	defer resp.Body.Close()
 
-	// Декодируем ответ
-	var yooResp YooKassaResponse
-	if err := json.NewDecoder(resp.Body).Decode(&yooResp); err != nil {
-		return "", "", fmt.Errorf("ошибка декодирования ответа Юкассы: %v", err)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &YooKassaError{StatusCode: resp.StatusCode}
+		// Тело ошибки необязательно: без него достаточно HTTP-статуса.
+		json.NewDecoder(resp.Body).Decode(apiErr)
+		return apiErr
 	}
 
-	if yooResp.ID == "" || yooResp.Confirm.ConfirmationURL == "" {
-		return "", "", fmt.Errorf("невалидный ответ Юкассы")
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("ошибка декодирования ответа Юкассы: %v", err)
 	}
-
-	// Возвращаем ID платежа и URL для оплаты
-	return yooResp.ID, yooResp.Confirm.ConfirmationURL, nil
+	return nil
 }
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Типы событий в уведомлениях Юкассы.
+const (
+	EventPaymentSucceeded         = "payment.succeeded"
+	EventPaymentWaitingForCapture = "payment.waiting_for_capture"
+	EventPaymentCanceled          = "payment.canceled"
+	EventRefundSucceeded          = "refund.succeeded"
+)
+
+// YooKassaEvent структура уведомления Юкассы. Объект декодируется в зависимости от типа события:
+// для событий payment.* – в YooKassaResponse, для refund.* – в YooKassaRefundResponse.
+type YooKassaEvent struct {
+	Type   string          `json:"type"`  // Всегда "notification"
+	Event  string          `json:"event"` // Тип события, например payment.succeeded
+	Object json.RawMessage `json:"object"`
+}
+
+// YooKassaCancellationDetails структура причины отмены платежа или возврата
+type YooKassaCancellationDetails struct {
+	Party  string `json:"party"`  // Кто отменил: yoo_kassa, payment_network, merchant
+	Reason string `json:"reason"` // Причина отмены, например insufficient_funds
+}
+
+// DecodeYooKassaEvent разбирает тело уведомления Юкассы.
+func DecodeYooKassaEvent(body []byte) (*YooKassaEvent, error) {
+	var event YooKassaEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования уведомления: %v", err)
+	}
+	if event.Event == "" || len(event.Object) == 0 {
+		return nil, fmt.Errorf("в уведомлении нет события или объекта")
+	}
+	return &event, nil
+}
+
+// Payment декодирует объект платежа из уведомления о событии payment.*.
+func (e *YooKassaEvent) Payment() (*YooKassaResponse, error) {
+	var payment YooKassaResponse
+	if err := json.Unmarshal(e.Object, &payment); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования платежа из уведомления %s: %v", e.Event, err)
+	}
+	if payment.ID == "" {
+		return nil, fmt.Errorf("в уведомлении %s нет ID платежа", e.Event)
+	}
+	return &payment, nil
+}
+
+// Refund декодирует объект возврата из уведомления о событии refund.*.
+func (e *YooKassaEvent) Refund() (*YooKassaRefundResponse, error) {
+	var refund YooKassaRefundResponse
+	if err := json.Unmarshal(e.Object, &refund); err != nil {
+		return nil, fmt.Errorf("ошибка декодирования возврата из уведомления %s: %v", e.Event, err)
+	}
+	if refund.ID == "" {
+		return nil, fmt.Errorf("в уведомлении %s нет ID возврата", e.Event)
+	}
+	return &refund, nil
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// useYooKassaServer направляет запросы к API Юкассы на тестовый сервер с обработчиком handler.
+func useYooKassaServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	previous := yooKassaAPIURL
+	yooKassaAPIURL = server.URL
+	t.Cleanup(func() { yooKassaAPIURL = previous })
+}
+
+func TestGetYooKassaPayment(t *testing.T) {
+	useYooKassaServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/payments/pay-1" {
+			t.Errorf("запрос к %s, ожидался /payments/pay-1", r.URL.Path)
+		}
+		w.Write([]byte(`{"id":"pay-1","status":"succeeded","amount":{"value":"100.00","currency":"RUB"}}`))
+	})
+
+	paymentResp, err := GetYooKassaPayment("pay-1")
+	if err != nil {
+		t.Fatalf("GetYooKassaPayment() вернул ошибку: %v", err)
+	}
+	if paymentResp.ID != "pay-1" || paymentResp.Status != "succeeded" {
+		t.Errorf("GetYooKassaPayment() = %+v", paymentResp)
+	}
+}
+
+func TestYooKassaErrorStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		wantCode      string
+		wantTemporary bool
+	}{
+		{"платеж не найден", http.StatusNotFound, `{"type":"error","code":"not_found","description":"Payment not found"}`, "not_found", false},
+		{"ошибка авторизации", http.StatusUnauthorized, `{"type":"error","code":"invalid_credentials","description":"Login or password is incorrect"}`, "invalid_credentials", false},
+		{"слишком много запросов", http.StatusTooManyRequests, `{"type":"error","code":"too_many_requests"}`, "too_many_requests", true},
+		{"сбой Юкассы без тела", http.StatusInternalServerError, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useYooKassaServer(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := GetYooKassaPayment("pay-1")
+			var apiErr *YooKassaError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("GetYooKassaPayment() = %v, ожидалась *YooKassaError", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Code != tt.wantCode {
+				t.Errorf("ошибка %+v, ожидались HTTP %d и код %q", apiErr, tt.status, tt.wantCode)
+			}
+			if apiErr.Temporary() != tt.wantTemporary {
+				t.Errorf("Temporary() = %v, ожидалось %v", apiErr.Temporary(), tt.wantTemporary)
+			}
+		})
+	}
+}
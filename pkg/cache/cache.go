@@ -1 +1,61 @@
 package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// item – запись кэша со временем истечения.
+type item struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// Cache – потокобезопасный in-memory кэш с ограниченным временем жизни записей.
+type Cache struct {
+	mu    sync.Mutex
+	items map[string]item
+}
+
+// New создаёт пустой кэш.
+func New() *Cache {
+	return &Cache{items: make(map[string]item)}
+}
+
+// Set сохраняет значение по ключу на время ttl.
+func (c *Cache) Set(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = item{value: value, expiresAt: time.Now().Add(ttl)}
+}
+
+// Get возвращает значение по ключу, если оно есть и не истекло.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	it, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(it.expiresAt) {
+		delete(c.items, key)
+		return nil, false
+	}
+	return it.value, true
+}
+
+// Take возвращает значение по ключу и удаляет его из кэша.
+func (c *Cache) Take(key string) (interface{}, bool) {
+	value, ok := c.Get(key)
+	if ok {
+		c.Delete(key)
+	}
+	return value, ok
+}
+
+// Delete удаляет значение по ключу.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, key)
+}